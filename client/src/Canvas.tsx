@@ -46,7 +46,7 @@ class Canvas extends React.Component<CanvasProps, CanvasState> {
     raster.position = new paper.Point(raster.size.width / 2, raster.size.height / 2)
 
     let locations = this.props.room.board.locations
-    for (let [idx, loc] of locations.entries()) {
+    for (let loc of locations) {
       for (let effect of loc.effects) {
         if (effect.type === EffectTypes.WORMHOLE) {
           let target = locations.find((loc) => loc.name === effect.wormhole_target)
@@ -74,12 +74,14 @@ class Canvas extends React.Component<CanvasProps, CanvasState> {
       let c = new Path.Circle(new Point(loc.x, loc.y), 5)
       c.fillColor = new paper.Color("green")
 
-      if (idx > locations.length - 2) {
-        continue
+      for (let next of loc.next) {
+        let next_loc = locations.find((loc) => loc.name === next)
+        if (!next_loc) {
+          continue
+        }
+        let l = new Path.Line(new Point(loc.x, loc.y), new Point(next_loc.x, next_loc.y))
+        l.strokeColor = new paper.Color("green")
       }
-      let next_loc = locations[idx+1]
-      let l = new Path.Line(new Point(loc.x, loc.y), new Point(next_loc.x, next_loc.y))
-      l.strokeColor = new paper.Color("green")
     }
 
     this.layer = new paper.Layer()
@@ -135,7 +137,7 @@ class Canvas extends React.Component<CanvasProps, CanvasState> {
           <Playerlist room={this.props.room} height={this.state.height} />
           <canvas ref={this.canvasRef} style={{"width": this.state.width, "height": this.state.height}} {...this.props} id="canvas" width={this.state.width} height={this.state.height} />
         </div>
-        <img src={serverURL + "/api/board"} onLoad={this.onImageLoad} alt="game board hello" id="baseimg" style={{"display": "none"}} />
+        <img src={serverURL + "/api/board?code=" + this.props.room.code} onLoad={this.onImageLoad} alt="game board hello" id="baseimg" style={{"display": "none"}} />
       </div>
     )
   }
@@ -18,6 +18,7 @@ enum TriggerTypes {
 enum InputTypes {
   BATTLE = "BATTLE",
   MOVE = "MOVE",
+  FORK = "FORK",
   VICTORY = "VICTORY",
 }
 
@@ -87,6 +88,7 @@ class Location {
   x: number
   y: number
   effects: LocationEffect[]
+  next: string[]
 
   constructor(props: any) {
     this.name = props.name
@@ -96,6 +98,7 @@ class Location {
     for (let effprop of props.effects) {
       this.effects.push(new LocationEffect(effprop))
     }
+    this.next = props.next || []
   }
 }
 
@@ -131,10 +134,14 @@ class InputRequest {
   names: string[]
   type: string
   received: Input[]
+  options: string[]
+  remaining: number
 
   constructor(props: any) {
     this.names = props.names
     this.type = props.type
+    this.options = props.options || []
+    this.remaining = props.remaining || 0
     this.received = []
     for (let input of props.received) {
       this.received.push(new Input(input))
@@ -23,10 +23,14 @@ class Interaction extends React.Component<InteractionProps,InteractionState> {
   }
 
   onStart = (event: any) => {
+    this.sendInput(event, 0)
+  }
+
+  sendInput = (event: any, value: number) => {
     event.preventDefault()
     event.stopPropagation()
 
-    api("POST", "input", {"code": this.props.lobby, "name": this.props.name, "value": 0}, (e: any) => {
+    api("POST", "input", {"code": this.props.lobby, "name": this.props.name, "value": value}, (e: any) => {
       if (e.target.response?.error) {
           toast(e.target.response.error)
       }
@@ -54,6 +58,10 @@ class Interaction extends React.Component<InteractionProps,InteractionState> {
           return <span className="cardanim buttonlist" onClick={this.onStart}>You won! Make a new rule</span>
         } else if (input_req.type === InputTypes.BATTLE) {
           return <span className="cardanim buttonlist" onClick={this.onStart}>Roll for battle!</span>
+        } else if (input_req.type === InputTypes.FORK) {
+          return input_req.options.map((option, idx) => {
+            return <span key={option} className="cardanim buttonlist" onClick={(e) => this.sendInput(e, idx)}>Go to {option} ({input_req.remaining} left)</span>
+          })
         }
       }
     }
@@ -1,7 +1,7 @@
 import { ToastContainer, toast } from 'react-toastify';
 import 'react-toastify/dist/ReactToastify.css';
 import React from 'react';
-import { api } from './api'
+import { api, setSession } from './api'
 
 interface JoinCreateProps {
   switchLobby: (code: string, name: string) => void
@@ -53,11 +53,13 @@ onCreate = (event: any) => {
     }
     const code = e.target.response.code
     const name = this.state.name
+    setSession(code, name)
     api("POST", "join", {"code": code, "name": name}, (e: any) => {
       if (e.target.status !== 201) {
           toast(e.target.response.error)
           return
       }
+      setSession(code, name, e.target.response.token)
       this.props.switchLobby(code, name)
     })
   })
@@ -75,11 +77,13 @@ onJoin = (event: any) => {
   }
   const code = this.state.join
   const name = this.state.name
+  setSession(code, name)
   api("POST", "join", {"code": code, "name": name}, (e: any) => {
     if (e.target.status !== 201) {
       toast(e.target.response?.error)
       return
     }
+    setSession(code, name, e.target.response.token)
     this.props.switchLobby(code, name)
   })
 }
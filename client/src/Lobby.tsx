@@ -1,7 +1,7 @@
 import React from 'react';
 import { ToastContainer, toast } from 'react-toastify';
 import 'react-toastify/dist/ReactToastify.css';
-import { api, wsURL } from './api'
+import { wsURL, session } from './api'
 import { Room } from './Elements'
 import Interaction from './Interaction'
 import History from './History'
@@ -14,6 +14,71 @@ interface LobbyProps {
   name: string;
 }
 
+// applyPatch updates the room as last sent by the server with one change from a patch message.
+// The ops match the patches the server builds in delta.go.
+const applyPatch = (raw: any, patch: any) => {
+  const player = () => raw.players.find((p: any) => p.name === patch.name)
+  const dropEffect = (effects: any[]) => effects.filter((eff: any) => eff.id !== patch.id)
+  switch (patch.op) {
+    case "player_joined":
+      raw.players.push(patch.player)
+      break
+    case "player_moved":
+      player().location = patch.to
+      break
+    case "player_status":
+      player().connected = patch.connected
+      break
+    case "current_player":
+      raw.current_player = patch.name || ""
+      break
+    case "input_removed":
+      raw.input_reqs.splice(patch.index || 0, 1)
+      break
+    case "input_pushed":
+      raw.input_reqs.splice(patch.index || 0, 0, patch.request)
+      break
+    case "input_updated":
+      raw.input_reqs[patch.index || 0] = patch.request
+      break
+    case "history_appended":
+      raw.history = [...(raw.history || []), ...patch.history]
+      raw.events = [...(raw.events || []), ...(patch.events || [])]
+      break
+    case "effect_added":
+      if (!patch.locations || patch.locations.length === 0) {
+        raw.board.effects.push(patch.effect)
+      }
+      for (let loc of raw.board.locations) {
+        if (patch.locations?.includes(loc.name)) {
+          loc.effects.push(patch.effect)
+        }
+      }
+      break
+    case "effect_removed":
+      raw.board.effects = dropEffect(raw.board.effects)
+      for (let loc of raw.board.locations) {
+        loc.effects = dropEffect(loc.effects)
+      }
+      break
+    case "turn_skips":
+      raw.turn_skips = patch.turn_skips || {}
+      break
+    case "prompts":
+      raw.prompts = patch.prompts
+      break
+    case "field_set":
+      raw[patch.field] = patch.value
+      break
+    case "board_changed":
+      raw.board = patch.board
+      break
+    case "room_replaced":
+      return patch.room
+  }
+  return raw
+}
+
 interface LobbyState {
   room?: Room
   img?: paper.Raster
@@ -23,16 +88,21 @@ class Lobby extends React.Component<LobbyProps, LobbyState> {
   timerId?: number
   ws?: WebSocket
   last_ws_update: Date
+  // raw is the room as of seq, kept as the server sent it so patches can be applied to it
+  raw?: any
+  seq: number
+  resyncing: boolean
 
   constructor(props: LobbyProps) {
     super(props)
     this.last_ws_update = new Date()
+    this.seq = 0
+    this.resyncing = false
     this.state = {
     }
   }
 
   componentDidMount() {
-    this.loadFromServer()
     this.ws = this.makeWS()
     this.timerId = window.setInterval(
       () => this.poll(),
@@ -41,7 +111,7 @@ class Lobby extends React.Component<LobbyProps, LobbyState> {
   }
 
   makeWS() {
-    let socket = new WebSocket(wsURL + `/api/stream?name=${this.props.name}&code=${this.props.lobby}`)
+    let socket = new WebSocket(wsURL + `/api/stream?name=${this.props.name}&code=${this.props.lobby}&token=${session.token}`)
     socket.onmessage = (ev: MessageEvent<any>) => {
       this.last_ws_update = new Date()
       let parsed = JSON.parse(ev.data)
@@ -52,17 +122,57 @@ class Lobby extends React.Component<LobbyProps, LobbyState> {
         toast(parsed.ping + " asks that you hurry up")
         return
       }
-      this.loadFromServer()
+      if ('closing' in parsed) {
+        toast("This room was closed after being idle for too long")
+        return
+      }
+      if (parsed.type === "snapshot") {
+        this.seq = parsed.seq
+        this.resyncing = false
+        this.setRoom(parsed.room)
+        return
+      }
+      if (parsed.type === "patch") {
+        this.applyPatches(socket, parsed)
+      }
     }
     return socket
   }
 
+  // applyPatches brings the room up to date with a patch message, or asks for a fresh snapshot if
+  // a message was missed along the way
+  applyPatches(socket: WebSocket, msg: any) {
+    if (this.resyncing || msg.seq <= this.seq) {
+      return
+    }
+    if (!this.raw || msg.seq !== this.seq + 1) {
+      this.resyncing = true
+      socket.send(JSON.stringify({"type": "resync"}))
+      return
+    }
+    let raw = this.raw
+    for (let patch of msg.patches) {
+      raw = applyPatch(raw, patch)
+    }
+    this.seq = msg.seq
+    this.setRoom(raw)
+  }
+
+  setRoom(raw: any) {
+    this.raw = raw
+    let room = new Room(raw)
+    this.setState((prevState) => {
+      return {
+        room: room
+      }
+    })
+  }
+
   poll() {
     let now = new Date()
     let timeDiff = (now.getTime() - this.last_ws_update.getTime()) / 1000
     if (timeDiff > 10)
     {
-      this.loadFromServer()
       this.ws?.close()
       this.ws = this.makeWS()
     }
@@ -74,21 +184,6 @@ class Lobby extends React.Component<LobbyProps, LobbyState> {
     }
   }
 
-  loadFromServer() {
-    api("POST", "state", {"code": this.props.lobby}, (e: any) => {
-      if (e.target.status !== 200) {
-        toast("error", e.target.response?.error)
-        return
-      }
-      let room = new Room(e.target.response)
-      this.setState((prevState) => {
-        return {
-          room: room
-        }
-      })
-    })
-  }
-
   render() {
     return (
       <div>
@@ -102,7 +197,7 @@ class Lobby extends React.Component<LobbyProps, LobbyState> {
               room={this.state.room} />
           </div>
           <History room={this.state.room} />
-          <Prompts room={this.state.room} />
+          <Prompts room={this.state.room} name={this.props.name} />
           <Rules
             room={this.state.room}
             name={this.props.name}
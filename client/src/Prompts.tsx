@@ -5,6 +5,7 @@ import { toast } from 'react-toastify';
 
 interface PromptsProps {
   room?: Room
+  name: string
 }
 
 interface PromptsState {
@@ -22,7 +23,7 @@ class Prompts extends React.Component<PromptsProps,PromptsState> {
     if (!this.props.room) {
       return
     }
-    api("POST", "prompt", {"code": this.props.room.code, "category": category, "level": level}, (e: any) => {
+    api("POST", "prompt", {"code": this.props.room.code, "name": this.props.name, "category": category, "level": level}, (e: any) => {
       if (e.target.status !== 200) {
         toast(e.target.response?.error)
         return
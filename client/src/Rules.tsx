@@ -126,7 +126,7 @@ class Rules extends React.Component<RulesProps,RulesState> {
     if (!this.props.room) {
       return
     }
-    api("POST", "rule", {"code": this.props.room.code, "delete": true, "id": eff.id}, (e: any) => {
+    api("POST", "rule", {"code": this.props.room.code, "name": this.props.name, "delete": true, "id": eff.id}, (e: any) => {
       if (e.target.status !== 200) {
         toast(e.target.response?.error)
         return
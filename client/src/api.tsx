@@ -12,6 +12,17 @@ const getWSUrl = () => {
 const serverURL: string = getServerUrl();
 const wsURL: string = getWSUrl();
 
+// The session token for the seat we're playing in, kept across page reloads
+const session = {token: ""}
+
+const setSession = (code: string, name: string, token: string | undefined = undefined) => {
+  const key = `tipsy-planets-token-${code}-${name}`
+  if (token) {
+    window.localStorage.setItem(key, token)
+  }
+  session.token = window.localStorage.getItem(key) || ""
+}
+
 const api = (action: string, route: string, content: any = undefined, onload: any = undefined, isImage: boolean = false) => {
   let xhr = new XMLHttpRequest()
   if (onload) {
@@ -24,6 +35,9 @@ const api = (action: string, route: string, content: any = undefined, onload: an
     xhr.setRequestHeader("Content-Type", "application/json;charset=UTF-8");
   }
   if (content) {
+    if (session.token) {
+      content = {...content, "token": session.token}
+    }
     xhr.send(JSON.stringify(
       content
     ))
@@ -32,4 +46,4 @@ const api = (action: string, route: string, content: any = undefined, onload: an
   }
 }
 
-export { api, serverURL, wsURL };
\ No newline at end of file
+export { api, serverURL, wsURL, session, setSession };
\ No newline at end of file
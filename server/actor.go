@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+const (
+	COMMAND_QUEUE_SIZE = 64
+)
+
+var ErrRoomClosed = errors.New("room is closed")
+
+// Command is a single operation on a room. Commands are only ever applied on the room's own
+// goroutine, so they may read and mutate the room freely.
+type Command interface {
+	// Apply returns the command result and whether the room changed and should be saved and broadcast
+	Apply(r *Room) (interface{}, bool, error)
+}
+
+type commandReply struct {
+	result interface{}
+	err error
+}
+
+type roomRequest struct {
+	cmd Command
+	reply chan commandReply
+}
+
+// Start launches the goroutine that owns the room. Everything that touches the room after this
+// must go through Submit.
+func (r *Room) Start(store RoomStore) {
+	r.store = store
+	r.cmds = make(chan roomRequest, COMMAND_QUEUE_SIZE)
+	r.done = make(chan struct{})
+	go r.run()
+}
+
+func (r *Room) run() {
+	r.updateTurnTimer()
+	for {
+		select {
+		case req := <-r.cmds:
+			result, err := r.execute(req.cmd)
+			req.reply <- commandReply{result, err}
+		case <-r.turnTimeout():
+			r.turnTimer = nil
+			r.execute(&TimeoutCmd{})
+		case <-r.done:
+			r.stopTurnTimer()
+			return
+		}
+	}
+}
+
+// execute applies cmd, then keeps, broadcasts and saves whatever it changed
+func (r *Room) execute(cmd Command) (interface{}, error) {
+	before := r.capture()
+	draws := r.Draws
+	entry := newJournalEntry(cmd)
+	r.display.begin()
+	result, changed, err := cmd.Apply(r)
+	// Drawing a random number changes what every later roll comes out as, so it has to be
+	// kept even if nothing players can see changed
+	drew := r.Draws != draws
+	if (changed || drew) && entry != nil {
+		r.journal(entry)
+	}
+	if r.updateTurnTimer() {
+		changed = true
+	}
+	if changed {
+		r.publish(before)
+	}
+	if changed || r.display.dirty {
+		r.notifyDisplays()
+	}
+	if changed || drew {
+		r.persist()
+	}
+	r.takeCheckpoint()
+	return result, err
+}
+
+// Submit runs cmd on the room goroutine and waits for its result
+func (r *Room) Submit(cmd Command) (interface{}, error) {
+	reply := make(chan commandReply, 1)
+	select {
+	case r.cmds <- roomRequest{cmd, reply}:
+	case <-r.done:
+		return nil, ErrRoomClosed
+	}
+
+	select {
+	case res := <-reply:
+		return res.result, res.err
+	case <-r.done:
+		// The command may have been the one that closed the room
+		select {
+		case res := <-reply:
+			return res.result, res.err
+		default:
+			return nil, ErrRoomClosed
+		}
+	}
+}
+
+// stop ends the room goroutine. Only call from within a command.
+func (r *Room) stop() {
+	close(r.done)
+}
+
+func (r *Room) persist() {
+	if r.store == nil {
+		return
+	}
+	err := r.store.Save(r)
+	if err != nil {
+		log.Println("Failed to persist room", r.Code, err.Error())
+	}
+}
+
+func (r *Room) snapshot() (json.RawMessage, error) {
+	return json.Marshal(r)
+}
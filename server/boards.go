@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"sync"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	DEFAULT_BOARD = "default"
+	BOARD_MANIFEST = "board.json"
+)
+
+// BoardPackage is a board layout together with the background image it is drawn over
+type BoardPackage struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Locations []*Location `json:"locations"`
+	Image []byte `json:"-"`
+	ImageType string `json:"-"`
+	// Params is what a generated board was built from, so it can be built again
+	Params *BoardParams `json:"params,omitempty"`
+
+	decode sync.Once
+	decoded image.Image
+	decodeErr error
+}
+
+// boardManifest is the board.json in each board directory. Image is relative to the directory.
+type boardManifest struct {
+	Name string `json:"name"`
+	Image string `json:"image"`
+	Locations []*Location `json:"locations"`
+}
+
+// newBoard makes a fresh copy of the board for a room to play on, so rooms never share effects
+func (p *BoardPackage) newBoard() *GameBoard {
+	locs := []*Location{}
+	for _, loc := range p.Locations {
+		effects := []*LocationEffect{}
+		for _, eff := range loc.Effects {
+			copied := *eff
+			copied.Trigger = BUILTIN
+			effects = append(effects, &copied)
+		}
+		locs = append(locs, &Location{Name: loc.Name, X: loc.X, Y: loc.Y, Effects: effects, Next: append([]string{}, loc.Next...)})
+	}
+	return &GameBoard{
+		Effects: []*LocationEffect{},
+		Locations: locs,
+	}
+}
+
+// BoardCatalog is every board rooms can be created with
+type BoardCatalog struct {
+	Boards map[string]*BoardPackage
+}
+
+func defaultBoardPackage(img []byte) *BoardPackage {
+	return &BoardPackage{
+		Id: DEFAULT_BOARD,
+		Name: "Tipsy Planets",
+		Locations: defaultGameBoard().Locations,
+		Image: img,
+		ImageType: "image/jpeg",
+	}
+}
+
+// LoadBoards reads every board directory under dir alongside the built in board. A missing
+// directory just means there are no custom boards, and boards that fail to load are skipped.
+func LoadBoards(dir string, defaultImg []byte) (*BoardCatalog, error) {
+	catalog := &BoardCatalog{Boards: map[string]*BoardPackage{DEFAULT_BOARD: defaultBoardPackage(defaultImg)}}
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == DEFAULT_BOARD {
+			continue
+		}
+		pkg, err := loadBoardPackage(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Println("Skipping board", entry.Name(), err.Error())
+			continue
+		}
+		catalog.Boards[pkg.Id] = pkg
+	}
+	log.Println("Loaded", len(catalog.Boards), "boards")
+	return catalog, nil
+}
+
+// loadBoardPackage reads a board directory, refusing boards that could break a game
+func loadBoardPackage(dir string) (*BoardPackage, error) {
+	pkg, err := readBoardPackage(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateBoard(pkg.Locations); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+func readBoardPackage(dir string) (*BoardPackage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, BOARD_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+	var manifest boardManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	for _, loc := range manifest.Locations {
+		if loc.Effects == nil {
+			loc.Effects = []*LocationEffect{}
+		}
+	}
+	linkLocations(manifest.Locations)
+	if manifest.Image == "" {
+		return nil, errors.New("board has no image")
+	}
+	img, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(manifest.Image)))
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &BoardPackage{
+		Id: filepath.Base(dir),
+		Name: manifest.Name,
+		Locations: manifest.Locations,
+		Image: img,
+		ImageType: http.DetectContentType(img),
+	}
+	if pkg.Name == "" {
+		pkg.Name = pkg.Id
+	}
+	return pkg, nil
+}
+
+// Get returns the board with id, or the built in board if there is no such board
+func (c *BoardCatalog) Get(id string) (*BoardPackage, bool) {
+	pkg, ok := c.Boards[id]
+	if !ok {
+		return c.Boards[DEFAULT_BOARD], false
+	}
+	return pkg, true
+}
+
+func HandleBoards(boards *BoardCatalog) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type BoardInfo struct {
+			Id string `json:"id"`
+			Name string `json:"name"`
+			Locations int `json:"locations"`
+		}
+		res := []*BoardInfo{}
+		for _, pkg := range boards.Boards {
+			res = append(res, &BoardInfo{Id: pkg.Id, Name: pkg.Name, Locations: len(pkg.Locations)})
+		}
+		sort.Slice(res, func(i, j int) bool {
+			return res[i].Id < res[j].Id
+		})
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// BoardImageCmd returns the package of the board the room is played on, which has its image
+type BoardImageCmd struct{}
+
+func (c *BoardImageCmd) Apply(r *Room) (interface{}, bool, error) {
+	return r.boardPkg, false, nil
+}
+
+// HandleImage serves the background image of a room's board, or the built in board without a code
+func HandleImage(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pkg, _ := rooms.Boards.Get(DEFAULT_BOARD)
+		if code := r.URL.Query().Get("code"); code != "" {
+			room, ok := rooms.Get(code)
+			if !ok {
+				WriteError(w, "no such lobby", http.StatusBadRequest)
+				return
+			}
+			res, err := room.Submit(&BoardImageCmd{})
+			if err != nil {
+				WriteCommandError(w, err)
+				return
+			}
+			pkg = res.(*BoardPackage)
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
+		w.Header().Set("Content-Type", pkg.ImageType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(pkg.Image)))
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write(pkg.Image)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
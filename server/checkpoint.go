@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+const (
+	CHECKPOINT_INTERVAL = 50
+	MAX_CHECKPOINTS = 16
+)
+
+// checkpoint is the room as it stood after the first step entries of its journal, so rebuilding
+// the room for an undo or a replay only has to apply what came after it
+type checkpoint struct {
+	step int
+	state json.RawMessage
+	paths map[string][]string
+}
+
+// takeCheckpoint keeps the room as it is now once enough has been journaled since the last one.
+// Past the limit every other older checkpoint is dropped, so recent steps stay cheap to rebuild and
+// older ones get further apart.
+func (r *Room) takeCheckpoint() {
+	last := 0
+	if len(r.checkpoints) > 0 {
+		last = r.checkpoints[len(r.checkpoints) - 1].step
+	}
+	if len(r.Journal) - last < CHECKPOINT_INTERVAL {
+		return
+	}
+
+	state, err := json.Marshal(storedRoom{Room: r, Seed: r.Seed, Draws: r.Draws})
+	if err != nil {
+		return
+	}
+	cp := &checkpoint{step: len(r.Journal), state: state, paths: map[string][]string{}}
+	for _, player := range r.Players {
+		cp.paths[player.Name] = append([]string{}, player.Path...)
+	}
+	r.checkpoints = append(r.checkpoints, cp)
+
+	if len(r.checkpoints) > MAX_CHECKPOINTS {
+		kept := []*checkpoint{}
+		for idx, cp := range r.checkpoints {
+			if idx % 2 == 1 || idx == len(r.checkpoints) - 1 {
+				kept = append(kept, cp)
+			}
+		}
+		r.checkpoints = kept
+	}
+}
+
+// forgetAfter drops everything rebuilt from the journal past step, once it no longer matches
+func (r *Room) forgetAfter(step int) {
+	kept := []*checkpoint{}
+	for _, cp := range r.checkpoints {
+		if cp.step <= step {
+			kept = append(kept, cp)
+		}
+	}
+	r.checkpoints = kept
+	if r.replayed != nil && len(r.replayed.Journal) > step {
+		r.replayed = nil
+	}
+}
+
+// restoreCheckpoint makes a fresh room from a checkpoint, holding the first cp.step entries of
+// journal. Unlike a room loaded from the store, players keep the presence they had.
+func (r *Room) restoreCheckpoint(cp *checkpoint, journal []*JournalEntry) (*Room, error) {
+	stored := storedRoom{Room: &Room{}}
+	if err := json.Unmarshal(cp.state, &stored); err != nil {
+		return nil, err
+	}
+	room := stored.Room
+	room.Seed = stored.Seed
+	room.Draws = stored.Draws
+	room.Journal = append([]*JournalEntry{}, journal[:cp.step]...)
+	connected := map[string]bool{}
+	for _, player := range room.Players {
+		player.Path = append([]string{}, cp.paths[player.Name]...)
+		connected[player.Name] = player.Connected
+	}
+	room.restore()
+	for _, player := range room.Players {
+		player.Connected = connected[player.Name]
+	}
+	room.boardPkg = r.boardPkg
+	return room, nil
+}
+
+// rebuild replays journal up to steps entries, or all of it when steps is negative. It starts from
+// the latest checkpoint at or before same, the number of entries journal shares with the room's own.
+func (r *Room) rebuild(journal []*JournalEntry, steps int, same int) (*Room, error) {
+	if steps < 0 || steps > len(journal) {
+		steps = len(journal)
+	}
+	if same > steps {
+		same = steps
+	}
+	for idx := len(r.checkpoints) - 1; idx >= 0; idx-- {
+		cp := r.checkpoints[idx]
+		if cp.step > same {
+			continue
+		}
+		base, err := r.restoreCheckpoint(cp, journal)
+		if err != nil {
+			break
+		}
+		return replayOnto(base, journal[cp.step:steps], -1)
+	}
+	return Replay(r.Code, r.Seed, r.boardPkg, journal, steps)
+}
+
+// replayTo is the room as it was after step entries of its journal. The last room replayed is kept
+// and carried on from when a later step is asked for, so stepping through a game is cheap. What it
+// returns is only good until the next call.
+func (r *Room) replayTo(step int) (*Room, error) {
+	if step < 0 || step > len(r.Journal) {
+		step = len(r.Journal)
+	}
+	if r.replayed != nil && len(r.replayed.Journal) <= step {
+		replayed, err := replayOnto(r.replayed, r.Journal[len(r.replayed.Journal):step], -1)
+		if err == nil {
+			return replayed, nil
+		}
+	}
+	replayed, err := r.rebuild(r.Journal, step, step)
+	if err != nil {
+		r.replayed = nil
+		return nil, err
+	}
+	r.replayed = replayed
+	return replayed, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// StateCmd returns a JSON snapshot of the room
+type StateCmd struct{}
+
+func (c *StateCmd) Apply(r *Room) (interface{}, bool, error) {
+	snap, err := r.snapshot()
+	return snap, false, err
+}
+
+// JoinCmd seats a new player and returns a snapshot along with their session token. Rejoining an
+// existing seat needs that seat's token, and no new token is issued.
+type JoinCmd struct {
+	Name string
+	Token string
+}
+
+func (c *JoinCmd) Apply(r *Room) (interface{}, bool, error) {
+	if player, _ := r.GetPlayer(c.Name); player != nil {
+		if !player.checkToken(c.Token) {
+			return nil, false, errors.New("name is already taken, reclaim the seat if it is yours")
+		}
+		snap, err := r.joinResult("")
+		return snap, false, err
+	}
+
+	if r.getSpectator(c.Name) != nil {
+		return nil, false, errors.New("name is already taken by a spectator")
+	}
+	if r.Locked {
+		return nil, false, errors.New("the lobby is locked")
+	}
+	if r.Settings.MaxPlayers > 0 && len(r.Players) >= r.Settings.MaxPlayers {
+		return nil, false, errors.New("the lobby is full")
+	}
+
+	token := r.seat(c.Name).issueToken()
+	snap, err := r.joinResult(token)
+	return snap, true, err
+}
+
+// ConnectCmd attaches a stream connection to a seated player
+type ConnectCmd struct {
+	Name string
+	Token string
+	Conn *Conn
+}
+
+func (c *ConnectCmd) Apply(r *Room) (interface{}, bool, error) {
+	player, err := r.Authenticate(c.Name, c.Token)
+	if err != nil {
+		return nil, false, err
+	}
+	player.Conns[c.Conn] = true
+	changed := player.updateConnected()
+	c.Conn.Send(r.Snapshot())
+	return nil, changed, nil
+}
+
+// DisconnectCmd detaches a stream connection once its peer has gone away
+type DisconnectCmd struct {
+	Name string
+	Conn *Conn
+}
+
+func (c *DisconnectCmd) Apply(r *Room) (interface{}, bool, error) {
+	player, _ := r.GetPlayer(c.Name)
+	if player == nil {
+		return nil, false, nil
+	}
+	delete(player.Conns, c.Conn)
+	changed := player.updateConnected()
+	if changed && player.Name == r.Host && !player.Connected {
+		r.handOverHost()
+	}
+	return nil, changed, nil
+}
+
+// SessionCmd checks a player's session token without changing anything
+type SessionCmd struct {
+	Name string
+	Token string
+}
+
+func (c *SessionCmd) Apply(r *Room) (interface{}, bool, error) {
+	_, err := r.Authenticate(c.Name, c.Token)
+	return nil, false, err
+}
+
+// InputCmd feeds a player's input into the game
+type InputCmd struct {
+	Input Input
+}
+
+func (c *InputCmd) Apply(r *Room) (interface{}, bool, error) {
+	changed, err := r.AdvanceRoomState(&c.Input)
+	if r.checkRecovery(err) {
+		changed = true
+	}
+	return nil, changed, err
+}
+
+// RuleCmd adds a custom rule, or removes one when Delete is set
+type RuleCmd struct {
+	Name string `json:"name"`
+	Id string `json:"id"`
+	Delete bool `json:"delete"`
+	Locations []string `json:"locations"`
+	FlavorText string `json:"flavor_text"`
+	Type string `json:"type"`
+	Trigger string `json:"trigger"`
+	KnockbackAmount int `json:"knockback_amount"`
+	WormholeTarget string `json:"wormhole_target"`
+	TurnskipAmount int `json:"turnskip_amount"`
+	ModifierAmount int `json:"modifier_amount"`
+	ModifierRolls int `json:"modifier_rolls"`
+	ModifierMode string `json:"modifier_mode"`
+}
+
+func (c *RuleCmd) effect() *LocationEffect {
+	return &LocationEffect{
+		Type: c.Type,
+		FlavorText: c.FlavorText,
+		KnockbackAmount: c.KnockbackAmount,
+		WormholeTarget: c.WormholeTarget,
+		TurnskipAmount: c.TurnskipAmount,
+		ModifierAmount: c.ModifierAmount,
+		ModifierRolls: c.ModifierRolls,
+		ModifierMode: c.ModifierMode,
+		Trigger: c.Trigger,
+	}
+}
+
+func (c *RuleCmd) Apply(r *Room) (interface{}, bool, error) {
+	if c.Delete {
+		if err := r.requireHost(c.Name); err != nil {
+			return nil, false, err
+		}
+		r.RemoveEffect(c.Id)
+		r.logEvent(&Event{Type: EVENT_RULE_REMOVED, Actor: c.Name, EffectId: c.Id})
+	} else if r.Settings.RequireRuleApproval && c.Name != r.Host {
+		r.proposeRule(c)
+	} else {
+		eff := c.effect()
+		r.AddEffect(eff, c.Locations)
+		r.CheckVictoryRule(c.Name)
+		r.logEvent(&Event{Type: EVENT_RULE_ADDED, Actor: c.Name, EffectId: eff.Id, EffectType: eff.Type})
+	}
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+// PromptCmd draws a prompt from a category, weighted by priority unless a level is given
+type PromptCmd struct {
+	Level string `json:"level"`
+	Category string `json:"category"`
+}
+
+func (c *PromptCmd) Apply(r *Room) (interface{}, bool, error) {
+	cat, ok := r.Prompts[c.Category]
+	if !ok {
+		return nil, false, errors.New("no such category")
+	}
+
+	chosen := func()*Prompts {
+		if c.Level == "" {
+			total := 0.0
+			for _, v := range cat.Prompts {
+				total = total + v.Priority
+			}
+			r := r.promptRng.Float64() * total
+
+			acc := 0.0
+			var last *Prompts
+			for _, v := range cat.Prompts {
+				last = v
+				acc = acc + v.Priority
+				if r < acc {
+					return v
+				}
+			}
+			return last
+		} else {
+			level, ok := cat.Prompts[c.Level]
+			if !ok {
+				return nil
+			}
+			return level
+		}
+	}()
+	if chosen == nil || len(chosen.Prompts) == 0 {
+		return nil, false, errors.New("no such level")
+	}
+
+	prompt := chosen.Prompts[r.promptRng.Intn(len(chosen.Prompts))]
+	r.recordPrompt(c.Category, prompt)
+	return prompt, false, nil
+}
+
+type Ping struct {
+	Ping string `json:"ping"`
+}
+
+// PingCmd nudges everyone the current input request is still waiting on
+type PingCmd struct {
+	Name string
+}
+
+func (c *PingCmd) Apply(r *Room) (interface{}, bool, error) {
+	if len(r.InputReqs) == 0 {
+		return nil, false, nil
+	}
+
+	recv := map[string]bool{}
+	for _, input := range r.InputReqs[0].Received {
+		recv[input.Name] = true
+	}
+
+	for _, name := range r.InputReqs[0].Names {
+		if gotten, _ := recv[name]; !gotten {
+			player, _ := r.GetPlayer(name)
+			if player == nil {
+				continue
+			}
+			for conn, _ := range player.Conns {
+				conn.Send(Ping{c.Name})
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// ReapCmd closes the room if it has been idle since before Cutoff and reports whether it did
+type ReapCmd struct {
+	Cutoff time.Time
+}
+
+func (c *ReapCmd) Apply(r *Room) (interface{}, bool, error) {
+	if r.LastUpdate.After(c.Cutoff) {
+		return false, false, nil
+	}
+	r.Close()
+	return true, false, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SEND_QUEUE_SIZE = 64
+	HEARTBEAT_PERIOD = 500 * time.Millisecond
+	WRITE_WAIT = 10 * time.Second
+	PONG_WAIT = 30 * time.Second
+	PING_PERIOD = (PONG_WAIT * 9) / 10
+	MAX_MESSAGE_SIZE = 4096
+)
+
+type Heartbeat struct {
+	Heartbeat bool `json:"heartbeat"`
+}
+
+// Conn wraps a websocket so that only its own write pump ever writes to it and only its read pump
+// ever reads from it. Everyone else enqueues messages with Send, which never blocks the caller on
+// a slow client.
+type Conn struct {
+	ws *websocket.Conn
+	send chan interface{}
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConn(ws *websocket.Conn) *Conn {
+	c := &Conn{
+		ws: ws,
+		send: make(chan interface{}, SEND_QUEUE_SIZE),
+		done: make(chan struct{}),
+	}
+	go c.writePump()
+	return c
+}
+
+// Send queues msg for delivery, closing the connection if the client has fallen too far behind
+func (c *Conn) Send(msg interface{}) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		c.Close()
+		return false
+	}
+}
+
+// Close stops the write pump, which then closes the underlying socket
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *Conn) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadPump processes incoming messages until the peer goes away or the connection is closed. It
+// must be called at most once and blocks, so run it on the goroutine that owns the connection.
+func (c *Conn) ReadPump(handle func(msg []byte)) {
+	defer c.Close()
+
+	c.ws.SetReadLimit(MAX_MESSAGE_SIZE)
+	c.ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+		return nil
+	})
+
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(PONG_WAIT))
+		if handle != nil {
+			handle(msg)
+		}
+	}
+}
+
+func (c *Conn) writePump() {
+	ticker := time.NewTicker(HEARTBEAT_PERIOD)
+	pinger := time.NewTicker(PING_PERIOD)
+	defer func() {
+		ticker.Stop()
+		pinger.Stop()
+		c.ws.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			if err := c.ws.WriteJSON(msg); err != nil {
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			if err := c.ws.WriteJSON(Heartbeat{}); err != nil {
+				c.Close()
+				return
+			}
+		case <-pinger.C:
+			c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			// Flush whatever was queued before the close, e.g. a closing notice
+			for {
+				select {
+				case msg := <-c.send:
+					c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+					if err := c.ws.WriteJSON(msg); err != nil {
+						return
+					}
+				default:
+					c.ws.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+					c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+)
+
+const (
+	SNAPSHOT = "snapshot"
+	PATCH = "patch"
+)
+
+const (
+	PLAYER_JOINED = "player_joined"
+	PLAYER_MOVED = "player_moved"
+	PLAYER_STATUS = "player_status"
+	CURRENT_PLAYER = "current_player"
+	INPUT_REMOVED = "input_removed"
+	INPUT_PUSHED = "input_pushed"
+	INPUT_UPDATED = "input_updated"
+	HISTORY_APPENDED = "history_appended"
+	EFFECT_ADDED = "effect_added"
+	EFFECT_REMOVED = "effect_removed"
+	TURN_SKIPS = "turn_skips"
+	PROMPTS = "prompts"
+	FIELD_SET = "field_set"
+	BOARD_CHANGED = "board_changed"
+	ROOM_REPLACED = "room_replaced"
+)
+
+// StreamMessage is what the room pushes down every stream. A snapshot carries the whole room at
+// Seq, a patch carries the changes that take the room from Seq-1 to Seq. Clients that see a gap in
+// Seq should send a resync message to get a fresh snapshot.
+type StreamMessage struct {
+	Seq uint64 `json:"seq"`
+	Type string `json:"type"`
+	Room json.RawMessage `json:"room,omitempty"`
+	Patches []*Patch `json:"patches,omitempty"`
+}
+
+type Patch struct {
+	Op string `json:"op"`
+	Name string `json:"name,omitempty"`
+	From string `json:"from,omitempty"`
+	To string `json:"to,omitempty"`
+	Connected *bool `json:"connected,omitempty"`
+	Player *Player `json:"player,omitempty"`
+	Index *int `json:"index,omitempty"`
+	Request *InputRequest `json:"request,omitempty"`
+	History []string `json:"history,omitempty"`
+	Events []*Event `json:"events,omitempty"`
+	Effect *LocationEffect `json:"effect,omitempty"`
+	Locations []string `json:"locations,omitempty"`
+	Id string `json:"id,omitempty"`
+	TurnSkips map[string]int `json:"turn_skips,omitempty"`
+	Prompts map[string]*PromptCategory `json:"prompts,omitempty"`
+	Field string `json:"field,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Room json.RawMessage `json:"room,omitempty"`
+	Board *GameBoard `json:"board,omitempty"`
+}
+
+type playerView struct {
+	location string
+	connected bool
+}
+
+type effectView struct {
+	effect *LocationEffect
+	locations []string
+}
+
+// roomView is a cheap copy of the parts of a room that patches describe, taken before each command
+type roomView struct {
+	order []string
+	players map[string]playerView
+	currentPlayer string
+	inputReqs []*InputRequest
+	received []int
+	historyLen int
+	effects map[string]*effectView
+	boardVersion int
+	rebuilds int
+	turnSkips map[string]int
+	prompts []byte
+	fields map[string][]byte
+}
+
+// fieldValues are the room fields that are small enough to resend whole whenever they change
+func (r *Room) fieldValues() map[string]interface{} {
+	return map[string]interface{}{
+		"host": r.Host,
+		"locked": r.Locked,
+		"settings": r.Settings,
+		"modifiers": r.Modifiers,
+		"pending_rules": r.PendingRules,
+		"pending_reclaims": r.PendingReclaims,
+		"needs_recovery": r.NeedsRecovery,
+		"recovery_reason": r.RecoveryReason,
+		"turn_deadline": r.TurnDeadline,
+		"turn_remaining_ms": r.TurnRemaining,
+		"timer_paused": r.TimerPaused,
+		"spectators": r.Spectators,
+	}
+}
+
+func (r *Room) encodeFields() map[string][]byte {
+	fields := map[string][]byte{}
+	for name, value := range r.fieldValues() {
+		fields[name], _ = json.Marshal(value)
+	}
+	return fields
+}
+
+func (r *Room) effectViews() map[string]*effectView {
+	effects := map[string]*effectView{}
+	for _, eff := range r.Board.Effects {
+		effects[eff.Id] = &effectView{effect: eff, locations: []string{}}
+	}
+	for _, loc := range r.Board.Locations {
+		for _, eff := range loc.Effects {
+			view, ok := effects[eff.Id]
+			if !ok {
+				view = &effectView{effect: eff, locations: []string{}}
+				effects[eff.Id] = view
+			}
+			view.locations = append(view.locations, loc.Name)
+		}
+	}
+	return effects
+}
+
+func (r *Room) capture() *roomView {
+	v := &roomView{
+		players: map[string]playerView{},
+		currentPlayer: r.CurrentPlayer,
+		inputReqs: append([]*InputRequest{}, r.InputReqs...),
+		historyLen: len(r.History),
+		effects: r.effectViews(),
+		boardVersion: r.boardVersion,
+		rebuilds: r.rebuilds,
+		turnSkips: map[string]int{},
+	}
+	for _, p := range r.Players {
+		v.order = append(v.order, p.Name)
+		v.players[p.Name] = playerView{p.Location, p.Connected}
+	}
+	for _, req := range r.InputReqs {
+		v.received = append(v.received, len(req.Received))
+	}
+	for k, n := range r.TurnSkips {
+		v.turnSkips[k] = n
+	}
+	v.prompts, _ = json.Marshal(r.Prompts)
+	v.fields = r.encodeFields()
+	return v
+}
+
+// diff describes how the room changed since before was captured
+func (r *Room) diff(before *roomView) []*Patch {
+	patches := []*Patch{}
+	intp := func(i int) *int { return &i }
+	boolp := func(b bool) *bool { return &b }
+
+	// A room rebuilt from its journal, like for an undo, can differ anywhere, even where it looks
+	// the same size as before
+	if before.rebuilds != r.rebuilds {
+		return r.replacePatch()
+	}
+
+	// Players are only ever appended, anything else means the room needs replacing wholesale
+	if len(r.Players) < len(before.order) {
+		return r.replacePatch()
+	}
+	for idx, p := range r.Players {
+		if idx < len(before.order) {
+			if before.order[idx] != p.Name {
+				return r.replacePatch()
+			}
+			prev := before.players[p.Name]
+			if prev.location != p.Location {
+				patches = append(patches, &Patch{Op: PLAYER_MOVED, Name: p.Name, From: prev.location, To: p.Location})
+			}
+			if prev.connected != p.Connected {
+				patches = append(patches, &Patch{Op: PLAYER_STATUS, Name: p.Name, Connected: boolp(p.Connected)})
+			}
+			continue
+		}
+		patches = append(patches, &Patch{Op: PLAYER_JOINED, Player: p})
+	}
+
+	if before.currentPlayer != r.CurrentPlayer {
+		patches = append(patches, &Patch{Op: CURRENT_PLAYER, Name: r.CurrentPlayer})
+	}
+
+	// Input requests keep their relative order, so removals from the old queue followed by
+	// insertions into the new one turn the old queue into the new one
+	after := map[*InputRequest]bool{}
+	for _, req := range r.InputReqs {
+		after[req] = true
+	}
+	kept := map[*InputRequest]int{}
+	for idx := len(before.inputReqs) - 1; idx >= 0; idx-- {
+		req := before.inputReqs[idx]
+		if !after[req] {
+			patches = append(patches, &Patch{Op: INPUT_REMOVED, Index: intp(idx)})
+		} else {
+			kept[req] = before.received[idx]
+		}
+	}
+	for idx, req := range r.InputReqs {
+		received, ok := kept[req]
+		if !ok {
+			patches = append(patches, &Patch{Op: INPUT_PUSHED, Index: intp(idx), Request: req})
+		} else if received != len(req.Received) {
+			patches = append(patches, &Patch{Op: INPUT_UPDATED, Index: intp(idx), Request: req})
+		}
+	}
+
+	if len(r.History) > before.historyLen {
+		patches = append(patches, &Patch{Op: HISTORY_APPENDED, History: r.History[before.historyLen:], Events: r.Events[before.historyLen:]})
+	} else if len(r.History) < before.historyLen {
+		return r.replacePatch()
+	}
+
+	// An edited board is resent whole, which covers every effect on it
+	effects := r.effectViews()
+	if before.boardVersion != r.boardVersion {
+		patches = append(patches, &Patch{Op: BOARD_CHANGED, Board: r.Board})
+		effects = before.effects
+	}
+	for id, _ := range before.effects {
+		if _, ok := effects[id]; !ok {
+			patches = append(patches, &Patch{Op: EFFECT_REMOVED, Id: id})
+		}
+	}
+	for id, view := range effects {
+		if _, ok := before.effects[id]; !ok {
+			patches = append(patches, &Patch{Op: EFFECT_ADDED, Effect: view.effect, Locations: view.locations})
+		}
+	}
+
+	if !reflect.DeepEqual(before.turnSkips, r.TurnSkips) && !(len(before.turnSkips) == 0 && len(r.TurnSkips) == 0) {
+		patches = append(patches, &Patch{Op: TURN_SKIPS, TurnSkips: r.TurnSkips})
+	}
+
+	if prompts, _ := json.Marshal(r.Prompts); string(prompts) != string(before.prompts) {
+		patches = append(patches, &Patch{Op: PROMPTS, Prompts: r.Prompts})
+	}
+
+	for name, value := range r.encodeFields() {
+		if string(value) != string(before.fields[name]) {
+			patches = append(patches, &Patch{Op: FIELD_SET, Field: name, Value: value})
+		}
+	}
+
+	return patches
+}
+
+func (r *Room) replacePatch() []*Patch {
+	snap, _ := r.snapshot()
+	return []*Patch{&Patch{Op: ROOM_REPLACED, Room: snap}}
+}
+
+// Snapshot encodes the message that brings a client fully up to date. Messages are encoded on the
+// room goroutine since the patches point into live room state.
+func (r *Room) Snapshot() json.RawMessage {
+	snap, _ := r.snapshot()
+	msg, _ := json.Marshal(&StreamMessage{Seq: r.Seq, Type: SNAPSHOT, Room: snap})
+	return msg
+}
+
+// publish bumps the room sequence number and broadcasts everything that changed since before
+func (r *Room) publish(before *roomView) {
+	r.Seq++
+	patches := r.diff(before)
+	if len(patches) == 0 {
+		patches = r.replacePatch()
+	}
+	msg, err := json.Marshal(&StreamMessage{Seq: r.Seq, Type: PATCH, Patches: patches})
+	if err != nil {
+		log.Println("Failed to encode patches for room", r.Code, err.Error())
+		return
+	}
+	r.NotifyPlayers(json.RawMessage(msg))
+}
+
+// ResyncCmd sends a fresh snapshot down a single connection
+type ResyncCmd struct {
+	Conn *Conn
+}
+
+func (c *ResyncCmd) Apply(r *Room) (interface{}, bool, error) {
+	c.Conn.Send(r.Snapshot())
+	return nil, false, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+// ops lists the ops of patches in order
+func ops(patches []*Patch) []string {
+	names := []string{}
+	for _, p := range patches {
+		names = append(names, p.Op)
+	}
+	return names
+}
+
+func hasOp(patches []*Patch, op string) bool {
+	for _, p := range patches {
+		if p.Op == op {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		// steps is how far into a game the command comes
+		steps int
+		cmd func(r *Room) Command
+		want []string
+		// replaced is whether the room should be sent whole instead
+		replaced bool
+	}{
+		{"join", 0, func(r *Room) Command { return &JoinCmd{Name: "c"} }, []string{PLAYER_JOINED}, false},
+		{"input", 3, func(r *Room) Command { return &InputCmd{Input: *nextInput(r)} }, []string{HISTORY_APPENDED}, false},
+		{"rule", 3, func(r *Room) Command {
+			return &RuleCmd{Name: "a", Type: GENERIC, Trigger: ONBATTLE, FlavorText: "%s drinks", Locations: []string{"[3]"}}
+		}, []string{EFFECT_ADDED, HISTORY_APPENDED}, false},
+		{"undo one input", 1, func(r *Room) Command { return &UndoCmd{Name: "a"} }, nil, true},
+		{"undo mid game", 9, func(r *Room) Command { return &UndoCmd{Name: "a"} }, nil, true},
+		{"undo a rule", 3, func(r *Room) Command {
+			r.execute(&RuleCmd{Name: "a", Type: GENERIC, Trigger: ONBATTLE, FlavorText: "%s drinks"})
+			return &UndoCmd{Name: "a"}
+		}, nil, true},
+	}
+
+	for _, tt := range tests {
+		for seed := int64(1); seed <= 10; seed++ {
+			r := testRoom(t, seed, "", "a", "b")
+			play(t, r, tt.steps)
+			if nextInput(r) == nil {
+				continue
+			}
+			cmd := tt.cmd(r)
+			before := r.capture()
+			if _, _, err := cmd.Apply(r); err != nil {
+				t.Fatalf("%s seed %d: %s", tt.name, seed, err.Error())
+			}
+			patches := r.diff(before)
+
+			if tt.replaced {
+				if len(patches) != 1 || patches[0].Op != ROOM_REPLACED {
+					t.Errorf("%s seed %d: patches %v, want the room replaced", tt.name, seed, ops(patches))
+				} else if snap, _ := r.snapshot(); string(patches[0].Room) != string(snap) {
+					t.Errorf("%s seed %d: replaced with something other than the room", tt.name, seed)
+				}
+				continue
+			}
+			if hasOp(patches, ROOM_REPLACED) {
+				t.Errorf("%s seed %d: room replaced, want %v", tt.name, seed, tt.want)
+			}
+			for _, op := range tt.want {
+				if !hasOp(patches, op) {
+					t.Errorf("%s seed %d: patches %v are missing %s", tt.name, seed, ops(patches), op)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ROLL_NORMAL = "NORMAL"
+	ROLL_ADVANTAGE = "ADVANTAGE"
+	ROLL_DISADVANTAGE = "DISADVANTAGE"
+)
+
+// RollModifier changes a player's rolls for a limited number of rolls
+type RollModifier struct {
+	Amount int `json:"amount"`
+	Mode string `json:"mode"`
+	Rolls int `json:"rolls"`
+}
+
+// Roll is the outcome of rolling a set of dice, kept so players can see the breakdown
+type Roll struct {
+	Dice []int `json:"dice"`
+	Discarded []int `json:"discarded,omitempty"`
+	Modifier int `json:"modifier"`
+	Mode string `json:"mode"`
+	Total int `json:"total"`
+}
+
+func sum(dice []int) int {
+	total := 0
+	for _, d := range dice {
+		total = total + d
+	}
+	return total
+}
+
+// Doubles is true when more than one die was rolled and they all came up the same
+func (roll *Roll) Doubles() bool {
+	if len(roll.Dice) < 2 {
+		return false
+	}
+	for _, d := range roll.Dice {
+		if d != roll.Dice[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (roll *Roll) String() string {
+	if len(roll.Dice) == 1 && roll.Modifier == 0 && roll.Mode == ROLL_NORMAL {
+		return fmt.Sprintf("a %d", roll.Total)
+	}
+
+	dice := []string{}
+	for _, d := range roll.Dice {
+		dice = append(dice, strconv.Itoa(d))
+	}
+	s := strings.Join(dice, " + ")
+	if roll.Modifier > 0 {
+		s = fmt.Sprintf("%s + %d", s, roll.Modifier)
+	} else if roll.Modifier < 0 {
+		s = fmt.Sprintf("%s - %d", s, -roll.Modifier)
+	}
+	s = fmt.Sprintf("%s = %d", s, roll.Total)
+
+	if roll.Mode != ROLL_NORMAL {
+		discarded := []string{}
+		for _, d := range roll.Discarded {
+			discarded = append(discarded, strconv.Itoa(d))
+		}
+		s = fmt.Sprintf("%s with %s over %s", s, strings.ToLower(roll.Mode), strings.Join(discarded, " + "))
+	}
+	return s
+}
+
+func (r *Room) rollSet() []int {
+	dice := []int{}
+	for i := 0; i < r.Settings.DiceCount; i++ {
+		dice = append(dice, r.rng.Intn(r.Settings.DiceSides) + 1)
+	}
+	return dice
+}
+
+// RollFor rolls the room's dice for a player, applying the room roll mode and the player's
+// modifiers and using up one roll of each modifier
+func (r *Room) RollFor(name string) *Roll {
+	advantage := 0
+	switch r.Settings.RollMode {
+	case ROLL_ADVANTAGE:
+		advantage++
+	case ROLL_DISADVANTAGE:
+		advantage--
+	}
+
+	roll := &Roll{Mode: ROLL_NORMAL}
+	active := []*RollModifier{}
+	for _, mod := range r.Modifiers[name] {
+		roll.Modifier = roll.Modifier + mod.Amount
+		switch mod.Mode {
+		case ROLL_ADVANTAGE:
+			advantage++
+		case ROLL_DISADVANTAGE:
+			advantage--
+		}
+		mod.Rolls--
+		if mod.Rolls > 0 {
+			active = append(active, mod)
+		}
+	}
+	if len(active) > 0 {
+		r.Modifiers[name] = active
+	} else {
+		delete(r.Modifiers, name)
+	}
+
+	roll.Dice = r.rollSet()
+	if advantage != 0 {
+		other := r.rollSet()
+		keepOther := sum(other) > sum(roll.Dice)
+		roll.Mode = ROLL_ADVANTAGE
+		if advantage < 0 {
+			keepOther = sum(other) < sum(roll.Dice)
+			roll.Mode = ROLL_DISADVANTAGE
+		}
+		if keepOther {
+			roll.Dice, other = other, roll.Dice
+		}
+		roll.Discarded = other
+	}
+
+	roll.Total = sum(roll.Dice) + roll.Modifier
+	if roll.Total < 0 {
+		roll.Total = 0
+	}
+	r.recordRoll(name, roll)
+	return roll
+}
+
+// AddModifier grants a player a temporary roll modifier
+func (r *Room) AddModifier(name string, mod *RollModifier) {
+	if mod.Rolls <= 0 {
+		return
+	}
+	r.Modifiers[name] = append(r.Modifiers[name], mod)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// rollRoom is just enough of a room to roll dice in
+func rollRoom(seed int64, settings Settings) *Room {
+	r := &Room{Seed: seed, Settings: settings, Modifiers: map[string][]*RollModifier{}, display: newDisplayState()}
+	r.seedRNG()
+	return r
+}
+
+func TestRollFor(t *testing.T) {
+	settings := func(count int, mode string) Settings {
+		s := defaultSettings()
+		s.DiceCount = count
+		s.RollMode = mode
+		return s
+	}
+
+	tests := []struct {
+		name string
+		settings Settings
+		modifiers []*RollModifier
+		wantMode string
+		wantModifier int
+		// keepHigh is whether the higher of two sets is kept, when there are two
+		keepHigh bool
+		wantLeft int
+	}{
+		{"one die", settings(1, ROLL_NORMAL), nil, ROLL_NORMAL, 0, false, 0},
+		{"two dice", settings(2, ROLL_NORMAL), nil, ROLL_NORMAL, 0, false, 0},
+		{"room advantage", settings(2, ROLL_ADVANTAGE), nil, ROLL_ADVANTAGE, 0, true, 0},
+		{"room disadvantage", settings(1, ROLL_DISADVANTAGE), nil, ROLL_DISADVANTAGE, 0, false, 0},
+		{"modifier adds", settings(1, ROLL_NORMAL), []*RollModifier{{Amount: 2, Rolls: 3}}, ROLL_NORMAL, 2, false, 1},
+		{"modifiers add up", settings(1, ROLL_NORMAL), []*RollModifier{{Amount: 2, Rolls: 1}, {Amount: -1, Rolls: 2}}, ROLL_NORMAL, 1, false, 1},
+		{"modifier gives advantage", settings(1, ROLL_NORMAL), []*RollModifier{{Mode: ROLL_ADVANTAGE, Rolls: 1}}, ROLL_ADVANTAGE, 0, true, 0},
+		{"modifier cancels room disadvantage", settings(1, ROLL_DISADVANTAGE), []*RollModifier{{Mode: ROLL_ADVANTAGE, Rolls: 1}}, ROLL_NORMAL, 0, false, 0},
+	}
+
+	for _, tt := range tests {
+		for seed := int64(1); seed <= 20; seed++ {
+			r := rollRoom(seed, tt.settings)
+			for _, mod := range tt.modifiers {
+				copied := *mod
+				r.AddModifier("a", &copied)
+			}
+			roll := r.RollFor("a")
+
+			// The room's source is seeded, so the same dice come off a plain source with the seed
+			ref := rand.New(rand.NewSource(seed))
+			set := func() []int {
+				dice := []int{}
+				for i := 0; i < tt.settings.DiceCount; i++ {
+					dice = append(dice, ref.Intn(tt.settings.DiceSides) + 1)
+				}
+				return dice
+			}
+			kept := set()
+			if tt.wantMode != ROLL_NORMAL {
+				other := set()
+				if (tt.wantMode == ROLL_ADVANTAGE) == (sum(other) > sum(kept)) && sum(other) != sum(kept) {
+					kept, other = other, kept
+				}
+				if !reflect.DeepEqual(roll.Discarded, other) {
+					t.Errorf("%s seed %d: discarded %v, want %v", tt.name, seed, roll.Discarded, other)
+				}
+				if tt.keepHigh && sum(roll.Dice) < sum(roll.Discarded) {
+					t.Errorf("%s seed %d: kept %v over higher %v", tt.name, seed, roll.Dice, roll.Discarded)
+				}
+			}
+			if !reflect.DeepEqual(roll.Dice, kept) {
+				t.Errorf("%s seed %d: dice %v, want %v", tt.name, seed, roll.Dice, kept)
+			}
+			if roll.Mode != tt.wantMode {
+				t.Errorf("%s seed %d: mode %s, want %s", tt.name, seed, roll.Mode, tt.wantMode)
+			}
+			if roll.Modifier != tt.wantModifier {
+				t.Errorf("%s seed %d: modifier %d, want %d", tt.name, seed, roll.Modifier, tt.wantModifier)
+			}
+			want := sum(kept) + tt.wantModifier
+			if want < 0 {
+				want = 0
+			}
+			if roll.Total != want {
+				t.Errorf("%s seed %d: total %d, want %d", tt.name, seed, roll.Total, want)
+			}
+			if len(r.Modifiers["a"]) != tt.wantLeft {
+				t.Errorf("%s seed %d: %d modifiers left, want %d", tt.name, seed, len(r.Modifiers["a"]), tt.wantLeft)
+			}
+			if r.Draws == 0 {
+				t.Errorf("%s seed %d: rolling drew nothing from the room's source", tt.name, seed)
+			}
+		}
+	}
+}
+
+func TestRollForDoubles(t *testing.T) {
+	seen := map[bool]bool{}
+	for seed := int64(1); seed <= 50; seed++ {
+		s := defaultSettings()
+		s.DiceCount = 2
+		roll := rollRoom(seed, s).RollFor("a")
+		want := roll.Dice[0] == roll.Dice[1]
+		if roll.Doubles() != want {
+			t.Errorf("seed %d: %v doubles is %v", seed, roll.Dice, roll.Doubles())
+		}
+		seen[want] = true
+	}
+	if !seen[true] || !seen[false] {
+		t.Errorf("seeds 1 to 50 should roll both doubles and not, got %v", seen)
+	}
+
+	if (&Roll{Dice: []int{4}}).Doubles() {
+		t.Errorf("a single die is never doubles")
+	}
+}
+
+func TestRollForRepeatsWithSeed(t *testing.T) {
+	s := defaultSettings()
+	s.DiceCount = 3
+	one, two := rollRoom(42, s), rollRoom(42, s)
+	for i := 0; i < 10; i++ {
+		a, b := one.RollFor("a"), two.RollFor("a")
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("roll %d: %v and %v differ with the same seed", i, a, b)
+		}
+	}
+	if one.Draws != two.Draws {
+		t.Errorf("draws %d and %d differ with the same seed", one.Draws, two.Draws)
+	}
+}
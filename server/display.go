@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DISPLAY = "display"
+)
+
+// MovePath is every location a player passed through in one go, including wormholes and knockbacks
+type MovePath struct {
+	Name string `json:"name"`
+	Path []string `json:"path"`
+}
+
+type DisplayRoll struct {
+	Name string `json:"name"`
+	Roll *Roll `json:"roll"`
+}
+
+type DisplayPrompt struct {
+	Category string `json:"category"`
+	Prompt string `json:"prompt"`
+}
+
+// DisplayFeed is what a shared screen needs to present the game: whose turn it is and what the game
+// is waiting on, the latest rolls and the moves they caused, and the last prompt drawn
+type DisplayFeed struct {
+	Seq uint64 `json:"seq"`
+	Type string `json:"type"`
+	CurrentPlayer string `json:"current_player"`
+	Request *InputRequest `json:"request"`
+	Rolls []*DisplayRoll `json:"rolls"`
+	Moves []*MovePath `json:"moves"`
+	Prompt *DisplayPrompt `json:"prompt"`
+}
+
+// displayState collects the rolls and moves of the latest command that had any
+type displayState struct {
+	rolls []*DisplayRoll
+	moves []*MovePath
+	prompt *DisplayPrompt
+	started bool
+	dirty bool
+}
+
+func newDisplayState() *displayState {
+	return &displayState{rolls: []*DisplayRoll{}, moves: []*MovePath{}}
+}
+
+// begin marks the start of a command, so the next roll or move replaces the ones before it
+func (d *displayState) begin() {
+	d.started = false
+	d.dirty = false
+}
+
+func (d *displayState) touch() {
+	if !d.started {
+		d.rolls = []*DisplayRoll{}
+		d.moves = []*MovePath{}
+		d.started = true
+	}
+	d.dirty = true
+}
+
+func (r *Room) recordRoll(name string, roll *Roll) {
+	r.display.touch()
+	r.display.rolls = append(r.display.rolls, &DisplayRoll{Name: name, Roll: roll})
+}
+
+// recordMove records the locations a player passed through, starting from where they were. It
+// extends the player's path if they are carrying on from where they just moved to.
+func (r *Room) recordMove(name string, visited []string) {
+	r.display.touch()
+	moves := r.display.moves
+	if len(moves) > 0 {
+		last := moves[len(moves) - 1]
+		if last.Name == name && last.Path[len(last.Path) - 1] == visited[0] {
+			last.Path = append(last.Path, visited[1:]...)
+			return
+		}
+	}
+	r.display.moves = append(moves, &MovePath{Name: name, Path: append([]string{}, visited...)})
+}
+
+func (r *Room) recordPrompt(category string, prompt string) {
+	r.display.prompt = &DisplayPrompt{Category: category, Prompt: prompt}
+	r.display.dirty = true
+}
+
+// displayFeed encodes the feed on the room goroutine, since it points into live room state
+func (r *Room) displayFeed() json.RawMessage {
+	feed := &DisplayFeed{
+		Seq: r.Seq,
+		Type: DISPLAY,
+		CurrentPlayer: r.CurrentPlayer,
+		Rolls: r.display.rolls,
+		Moves: r.display.moves,
+		Prompt: r.display.prompt,
+	}
+	if len(r.InputReqs) > 0 {
+		feed.Request = r.InputReqs[0]
+	}
+	msg, err := json.Marshal(feed)
+	if err != nil {
+		log.Println("Failed to encode the display feed for room", r.Code, err.Error())
+		return nil
+	}
+	return msg
+}
+
+// notifyDisplays sends the display feed to every display stream
+func (r *Room) notifyDisplays() {
+	if len(r.displays) == 0 {
+		return
+	}
+	feed := r.displayFeed()
+	if feed == nil {
+		return
+	}
+	for conn, _ := range r.displays {
+		conn.Send(feed)
+	}
+}
+
+// DisplayCmd attaches a shared screen. It gets everything spectators do as well as the display feed.
+type DisplayCmd struct {
+	Conn *Conn
+}
+
+func (c *DisplayCmd) Apply(r *Room) (interface{}, bool, error) {
+	r.displays[c.Conn] = true
+	c.Conn.Send(r.Snapshot())
+	if feed := r.displayFeed(); feed != nil {
+		c.Conn.Send(feed)
+	}
+	return nil, false, nil
+}
+
+// UndisplayCmd detaches a shared screen once it has gone away
+type UndisplayCmd struct {
+	Conn *Conn
+}
+
+func (c *UndisplayCmd) Apply(r *Room) (interface{}, bool, error) {
+	delete(r.displays, c.Conn)
+	return nil, false, nil
+}
+
+// serveDisplay runs a display stream until it goes away
+func serveDisplay(room *Room, upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		log.Println("Failed to upgrade display stream in room", room.Code, err.Error())
+		return
+	}
+	conn := NewConn(ws)
+
+	_, err = room.Submit(&DisplayCmd{Conn: conn})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.ReadPump(func(msg []byte) {
+		handleSpectatorMessage(room, conn, msg)
+	})
+	room.Submit(&UndisplayCmd{Conn: conn})
+}
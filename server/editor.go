@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	EDIT_ADD = "ADD"
+	EDIT_REMOVE = "REMOVE"
+	EDIT_MOVE = "MOVE"
+	EDIT_UPDATE = "UPDATE"
+)
+
+// BoardEditCmd changes the room's board before the game starts. ADD puts Location on the board at Index, or
+// at the end without one. REMOVE takes Target off the board, MOVE puts Target at Index, and UPDATE
+// applies Location over Target so it only needs the fields being changed. Effects given with a
+// location replace its built in effects, and rules players added to it are kept. Boards that were a
+// single track stay one, unless the edit gives its own next. The board is validated before any
+// change is kept.
+type BoardEditCmd struct {
+	Name string
+	Op string
+	Target string
+	Index *int
+	Location json.RawMessage
+}
+
+func (c *BoardEditCmd) Apply(r *Room) (interface{}, bool, error) {
+	if r.RoundUnderway() {
+		return nil, false, errors.New("the board can only be edited before the game starts")
+	}
+
+	var given map[string]json.RawMessage
+	if len(c.Location) > 0 {
+		if err := json.Unmarshal(c.Location, &given); err != nil {
+			return nil, false, err
+		}
+	}
+	_, givesNext := given["next"]
+	_, givesEffects := given["effects"]
+
+	locs := copyLocations(r.Board.Locations)
+	global := copyEffects(r.Board.Effects)
+	track := isTrack(locs)
+	tidx := -1
+	for idx, loc := range locs {
+		if loc.Name == c.Target {
+			tidx = idx
+		}
+	}
+	if c.Op != EDIT_ADD && tidx < 0 {
+		return nil, false, errors.New("no such location " + c.Target)
+	}
+	index := func(max int) (int, error) {
+		if c.Index == nil {
+			return max, nil
+		}
+		if *c.Index < 0 || *c.Index > max {
+			return 0, errors.New("index is off the board")
+		}
+		return *c.Index, nil
+	}
+
+	var edited *Location
+	renamed := map[string]string{}
+	switch c.Op {
+	case EDIT_ADD:
+		edited = &Location{Effects: []*LocationEffect{}, Next: []string{}}
+		if err := json.Unmarshal(c.Location, edited); err != nil {
+			return nil, false, err
+		}
+		idx, err := index(len(locs))
+		if err != nil {
+			return nil, false, err
+		}
+		locs = append(locs[:idx], append([]*Location{edited}, locs[idx:]...)...)
+	case EDIT_REMOVE:
+		removed := locs[tidx]
+		locs = append(locs[:tidx], locs[tidx + 1:]...)
+		for _, loc := range locs {
+			next := []string{}
+			for _, name := range loc.Next {
+				if name != removed.Name {
+					next = append(next, name)
+				}
+			}
+			loc.Next = next
+		}
+	case EDIT_MOVE:
+		if c.Index == nil {
+			return nil, false, errors.New("moving a location needs the index to move it to")
+		}
+		moved := locs[tidx]
+		locs = append(locs[:tidx], locs[tidx + 1:]...)
+		idx, err := index(len(locs))
+		if err != nil {
+			return nil, false, err
+		}
+		locs = append(locs[:idx], append([]*Location{moved}, locs[idx:]...)...)
+	case EDIT_UPDATE:
+		edited = locs[tidx]
+		previous := edited.Name
+		if givesEffects {
+			// Decoding into the old effects would leave their fields behind on the new ones
+			edited.Effects = nil
+		}
+		if err := json.Unmarshal(c.Location, edited); err != nil {
+			return nil, false, err
+		}
+		if edited.Name != previous {
+			renamed[previous] = edited.Name
+			renameLocation(locs, global, previous, edited.Name)
+		}
+	default:
+		return nil, false, errors.New("unknown board edit " + c.Op)
+	}
+
+	if edited != nil && givesEffects {
+		for _, eff := range edited.Effects {
+			eff.Trigger = BUILTIN
+		}
+		if c.Op == EDIT_UPDATE {
+			// Rules players added here survive having the built in effects replaced
+			for _, eff := range r.Board.Locations[tidx].Effects {
+				if eff.Trigger != BUILTIN {
+					edited.Effects = append(edited.Effects, eff)
+				}
+			}
+		}
+	}
+	if edited != nil && edited.Effects == nil {
+		edited.Effects = []*LocationEffect{}
+	}
+	if track && !givesNext {
+		for _, loc := range locs {
+			loc.Next = nil
+		}
+	}
+	linkLocations(locs)
+
+	if err := ValidateBoard(builtinLocations(locs)); err != nil {
+		return nil, false, err
+	}
+	if err := ruleProblems(locs, global); err != nil {
+		return nil, false, err
+	}
+
+	if edited != nil && givesEffects {
+		for _, eff := range edited.Effects {
+			if eff.Trigger == BUILTIN {
+				eff.Id = r.newId()
+			}
+		}
+	}
+	r.Board.Locations = locs
+	r.Board.Effects = global
+	r.boardVersion++
+	for _, player := range r.Players {
+		if to, ok := renamed[player.Location]; ok {
+			player.Location = to
+		}
+		if loc, _ := r.Board.GetLocation(player.Location); loc == nil {
+			player.Location = r.Board.Locations[0].Name
+		}
+		player.Path = []string{player.Location}
+	}
+
+	event := &Event{Type: EVENT_BOARD_EDITED, Actor: c.Name, Target: c.Target, Detail: c.Op}
+	if edited != nil {
+		event.Target = edited.Name
+	}
+	if edited != nil && edited.Name != c.Target && c.Op == EDIT_UPDATE {
+		event.From = c.Target
+	}
+	r.logEvent(event)
+	r.LastUpdate = time.Now()
+	// Encoded here, since the board keeps changing after the reply leaves the room
+	board, err := json.Marshal(r.Board)
+	return json.RawMessage(board), true, err
+}
+
+// copyLocations copies locations deep enough that editing the copies leaves the originals alone
+func copyLocations(locations []*Location) []*Location {
+	locs := []*Location{}
+	for _, loc := range locations {
+		locs = append(locs, &Location{Name: loc.Name, X: loc.X, Y: loc.Y, Effects: copyEffects(loc.Effects), Next: append([]string{}, loc.Next...)})
+	}
+	return locs
+}
+
+func copyEffects(effects []*LocationEffect) []*LocationEffect {
+	copied := []*LocationEffect{}
+	for _, eff := range effects {
+		c := *eff
+		copied = append(copied, &c)
+	}
+	return copied
+}
+
+// builtinLocations is the locations with only their built in effects, which are the ones a board
+// has to get right. Rules players add are up to them.
+func builtinLocations(locations []*Location) []*Location {
+	locs := []*Location{}
+	for _, loc := range locations {
+		effects := []*LocationEffect{}
+		for _, eff := range loc.Effects {
+			if eff.Trigger == BUILTIN {
+				effects = append(effects, eff)
+			}
+		}
+		locs = append(locs, &Location{Name: loc.Name, X: loc.X, Y: loc.Y, Effects: effects, Next: loc.Next})
+	}
+	return locs
+}
+
+// isTrack is whether every location just leads on to the one listed after it
+func isTrack(locations []*Location) bool {
+	for idx, loc := range locations {
+		if idx == len(locations) - 1 {
+			return len(loc.Next) == 0
+		}
+		if len(loc.Next) != 1 || loc.Next[0] != locations[idx + 1].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// renameLocation points every edge and wormhole that went to from at to instead, including the
+// wormholes in rules for the whole board
+func renameLocation(locations []*Location, global []*LocationEffect, from string, to string) {
+	rename := func(effects []*LocationEffect) {
+		for _, eff := range effects {
+			if eff.Type == WORMHOLE && eff.WormholeTarget == from {
+				eff.WormholeTarget = to
+			}
+		}
+	}
+	for _, loc := range locations {
+		for idx, name := range loc.Next {
+			if name == from {
+				loc.Next[idx] = to
+			}
+		}
+		rename(loc.Effects)
+	}
+	rename(global)
+}
+
+// ruleProblems checks the wormholes in rules players added, at locations or for the whole board,
+// still go somewhere on the edited board. The rest of a rule is up to the players who added it.
+func ruleProblems(locations []*Location, global []*LocationEffect) error {
+	names := map[string]int{}
+	for idx, loc := range locations {
+		names[loc.Name] = idx
+	}
+	errs := BoardErrors{}
+	for _, loc := range locations {
+		for _, eff := range loc.Effects {
+			if eff.Trigger == BUILTIN || eff.Type != WORMHOLE {
+				continue
+			}
+			if _, ok := names[eff.WormholeTarget]; !ok {
+				errs = append(errs, fmt.Sprintf("wormhole rule at %s goes to %s which does not exist", loc.Name, eff.WormholeTarget))
+			}
+		}
+	}
+	for _, eff := range global {
+		if eff.Type != WORMHOLE {
+			continue
+		}
+		if _, ok := names[eff.WormholeTarget]; !ok {
+			errs = append(errs, fmt.Sprintf("wormhole rule for the whole board goes to %s which does not exist", eff.WormholeTarget))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func HandleBoardEdit(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type BoardEditReq struct {
+			Code string
+			Name string
+			Token string
+			Op string
+			Target string
+			Index *int
+			Location json.RawMessage
+		}
+		var req BoardEditReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from board request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		board, err := room.Submit(&AuthCmd{req.Name, req.Token, &HostCmd{req.Name, &BoardEditCmd{
+			Name: req.Name,
+			Op: req.Op,
+			Target: req.Target,
+			Index: req.Index,
+			Location: req.Location,
+		}}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(board)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	EVENT_GAME_STARTED = "GAME_STARTED"
+	EVENT_ROLL = "ROLL"
+	EVENT_DOUBLES = "DOUBLES"
+	EVENT_MOVE = "MOVE"
+	EVENT_BATTLE_ROLL = "BATTLE_ROLL"
+	EVENT_BATTLE_RESULT = "BATTLE_RESULT"
+	EVENT_EFFECT = "EFFECT"
+	EVENT_TURN_SKIPPED = "TURN_SKIPPED"
+	EVENT_VICTORY = "VICTORY"
+	EVENT_RULE_ADDED = "RULE_ADDED"
+	EVENT_RULE_REMOVED = "RULE_REMOVED"
+	EVENT_RULE_PROPOSED = "RULE_PROPOSED"
+	EVENT_RULE_APPROVED = "RULE_APPROVED"
+	EVENT_RULE_VETOED = "RULE_VETOED"
+	EVENT_JOIN = "JOIN"
+	EVENT_LEAVE = "LEAVE"
+	EVENT_KICK = "KICK"
+	EVENT_HOST_CHANGED = "HOST_CHANGED"
+	EVENT_LOCKED = "LOCKED"
+	EVENT_UNLOCKED = "UNLOCKED"
+	EVENT_RESTARTED = "RESTARTED"
+	EVENT_SETTINGS_CHANGED = "SETTINGS_CHANGED"
+	EVENT_RECLAIM_REQUESTED = "RECLAIM_REQUESTED"
+	EVENT_RECLAIM_APPROVED = "RECLAIM_APPROVED"
+	EVENT_RECLAIMED = "RECLAIMED"
+	EVENT_BROKEN = "BROKEN"
+	EVENT_REPAIRED = "REPAIRED"
+	EVENT_UNDO = "UNDO"
+	EVENT_TIMEOUT = "TIMEOUT"
+	EVENT_TIMER_PAUSED = "TIMER_PAUSED"
+	EVENT_TIMER_RESUMED = "TIMER_RESUMED"
+	EVENT_BOARD_EDITED = "BOARD_EDITED"
+	// MESSAGE is a plain line of history from before events existed
+	EVENT_MESSAGE = "MESSAGE"
+)
+
+// Event is one typed entry in the room history. Only the fields that make sense for the type are
+// set, and Text is the line the event renders to for clients that just show the history.
+type Event struct {
+	Type string `json:"type"`
+	Time time.Time `json:"time"`
+	Actor string `json:"actor,omitempty"`
+	Target string `json:"target,omitempty"`
+	From string `json:"from,omitempty"`
+	To string `json:"to,omitempty"`
+	Amount int `json:"amount,omitempty"`
+	Roll *Roll `json:"roll,omitempty"`
+	EffectId string `json:"effect_id,omitempty"`
+	EffectType string `json:"effect_type,omitempty"`
+	// Detail is the flavor text of an effect or the reason the game broke
+	Detail string `json:"detail,omitempty"`
+	Text string `json:"text"`
+}
+
+func (e *Event) render() string {
+	switch e.Type {
+	case EVENT_GAME_STARTED:
+		return fmt.Sprintf("%s started a new game", e.Actor)
+	case EVENT_ROLL:
+		return fmt.Sprintf("%s rolled %s and moved from %s to %s", e.Actor, e.Roll, e.From, e.To)
+	case EVENT_DOUBLES:
+		return fmt.Sprintf("%s rolled doubles and goes again!", e.Actor)
+	case EVENT_MOVE:
+		return fmt.Sprintf("%s moved from %s to %s", e.Actor, e.From, e.To)
+	case EVENT_BATTLE_ROLL:
+		return fmt.Sprintf("%s rolled %s!", e.Actor, e.Roll)
+	case EVENT_BATTLE_RESULT:
+		if e.Amount == 0 {
+			return "Battle was a tie!"
+		}
+		return fmt.Sprintf("%s beat %s by %d", e.Actor, e.Target, e.Amount)
+	case EVENT_EFFECT:
+		return fmt.Sprintf(e.Detail, e.Actor)
+	case EVENT_TURN_SKIPPED:
+		return fmt.Sprintf("Skipped %s's turn", e.Actor)
+	case EVENT_VICTORY:
+		return fmt.Sprintf("%s won the round!", e.Actor)
+	case EVENT_RULE_ADDED:
+		return fmt.Sprintf("%s added a rule", e.Actor)
+	case EVENT_RULE_REMOVED:
+		return fmt.Sprintf("%s removed a rule", e.Actor)
+	case EVENT_RULE_PROPOSED:
+		return fmt.Sprintf("%s proposed a rule for the host to approve", e.Actor)
+	case EVENT_RULE_APPROVED:
+		return fmt.Sprintf("%s approved %s's rule", e.Actor, e.Target)
+	case EVENT_RULE_VETOED:
+		if e.Target == "" {
+			return fmt.Sprintf("%s vetoed a rule", e.Actor)
+		}
+		return fmt.Sprintf("%s vetoed %s's rule", e.Actor, e.Target)
+	case EVENT_JOIN:
+		return fmt.Sprintf("%s joined the game", e.Actor)
+	case EVENT_LEAVE:
+		return fmt.Sprintf("%s left the game", e.Actor)
+	case EVENT_KICK:
+		return fmt.Sprintf("%s kicked %s", e.Actor, e.Target)
+	case EVENT_HOST_CHANGED:
+		if e.Actor == "" {
+			return fmt.Sprintf("%s is now the host", e.Target)
+		}
+		return fmt.Sprintf("%s made %s the host", e.Actor, e.Target)
+	case EVENT_LOCKED:
+		return fmt.Sprintf("%s locked the lobby", e.Actor)
+	case EVENT_UNLOCKED:
+		return fmt.Sprintf("%s unlocked the lobby", e.Actor)
+	case EVENT_RESTARTED:
+		return fmt.Sprintf("%s restarted the game", e.Actor)
+	case EVENT_SETTINGS_CHANGED:
+		return fmt.Sprintf("%s changed the settings", e.Actor)
+	case EVENT_BOARD_EDITED:
+		switch e.Detail {
+		case EDIT_ADD:
+			return fmt.Sprintf("%s added %s to the board", e.Actor, e.Target)
+		case EDIT_REMOVE:
+			return fmt.Sprintf("%s took %s off the board", e.Actor, e.Target)
+		case EDIT_MOVE:
+			return fmt.Sprintf("%s moved %s along the board", e.Actor, e.Target)
+		default:
+			if e.From != "" {
+				return fmt.Sprintf("%s renamed %s to %s", e.Actor, e.From, e.Target)
+			}
+			return fmt.Sprintf("%s changed %s on the board", e.Actor, e.Target)
+		}
+	case EVENT_RECLAIM_REQUESTED:
+		return fmt.Sprintf("%s is asking to reclaim their seat", e.Actor)
+	case EVENT_RECLAIM_APPROVED:
+		return fmt.Sprintf("%s let %s reclaim their seat", e.Actor, e.Target)
+	case EVENT_RECLAIMED:
+		return fmt.Sprintf("%s reclaimed their seat", e.Actor)
+	case EVENT_BROKEN:
+		return fmt.Sprintf("The game hit a problem and needs to be repaired: %s", e.Detail)
+	case EVENT_REPAIRED:
+		return fmt.Sprintf("%s repaired the game", e.Actor)
+	case EVENT_UNDO:
+		return fmt.Sprintf("%s undid the last action", e.Actor)
+	case EVENT_TIMEOUT:
+		if e.Amount > 0 {
+			return fmt.Sprintf("%s ran out of time and drinks while the dice roll for them", e.Actor)
+		}
+		return fmt.Sprintf("%s ran out of time so the dice roll for them", e.Actor)
+	case EVENT_TIMER_PAUSED:
+		return fmt.Sprintf("%s paused the turn timer", e.Actor)
+	case EVENT_TIMER_RESUMED:
+		return fmt.Sprintf("%s restarted the turn timer", e.Actor)
+	default:
+		return e.Text
+	}
+}
+
+// now is the current time, or when the command being replayed first ran
+func (r *Room) now() time.Time {
+	if !r.clock.IsZero() {
+		return r.clock
+	}
+	return time.Now()
+}
+
+// logEvent stamps and renders an event and adds it to the history. History keeps the rendered
+// lines alongside Events, one for one, for clients that only read text.
+func (r *Room) logEvent(e *Event) {
+	e.Time = r.now()
+	e.Text = e.render()
+	r.Events = append(r.Events, e)
+	r.History = append(r.History, e.Text)
+}
+
+// logEffect records an effect landing on a player, along with how strong it was
+func (r *Room) logEffect(p *Player, effect *LocationEffect) {
+	e := &Event{Type: EVENT_EFFECT, Actor: p.Name, To: p.Location, EffectId: effect.Id, EffectType: effect.Type, Detail: effect.FlavorText}
+	switch effect.Type {
+	case WORMHOLE:
+		e.To = effect.WormholeTarget
+	case KNOCKBACK:
+		e.Amount = effect.KnockbackAmount
+	case TURNSKIP:
+		e.Amount = effect.TurnskipAmount
+	case MODIFIER:
+		e.Amount = effect.ModifierAmount
+	}
+	r.logEvent(e)
+}
+
+// restoreEvents turns history saved before events existed into plain message events
+func (r *Room) restoreEvents() {
+	if r.Events == nil {
+		r.Events = []*Event{}
+	}
+	for idx := len(r.Events); idx < len(r.History); idx++ {
+		r.Events = append(r.Events, &Event{Type: EVENT_MESSAGE, Text: r.History[idx]})
+	}
+}
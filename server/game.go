@@ -2,11 +2,8 @@ package main
 
 import (
 	"math/rand"
-	"sync"
 	"time"
 	"fmt"
-	"log"
-	"github.com/gorilla/websocket"
 	"errors"
 	"github.com/google/uuid"
 )
@@ -22,6 +19,7 @@ const (
 	WORMHOLE = "WORMHOLE"
 	GENERIC = "GENERIC"
 	TURNSKIP = "TURNSKIP"
+	MODIFIER = "MODIFIER"
 )
 
 const (
@@ -148,14 +146,71 @@ func newPromptsMapping() map[string]*PromptCategory {
 	return ret
 }
 
+const (
+	VICTORY_REACH = "REACH"
+	VICTORY_EXACT = "EXACT"
+)
+
+const (
+	TURN_ORDER_SEATED = "SEATED"
+	TURN_ORDER_RANDOM = "RANDOM"
+)
+
 type Settings struct {
-	RequireExactVictory bool `json:"require_exact_victory"`
+	DiceCount int `json:"dice_count"`
+	DiceSides int `json:"dice_sides"`
+	RollMode string `json:"roll_mode"`
+	DoublesRollAgain bool `json:"doubles_roll_again"`
+	Battles bool `json:"battles"`
+	MaxPlayers int `json:"max_players"`
+	TurnOrder string `json:"turn_order"`
+	BuiltinEffects bool `json:"builtin_effects"`
+	VictoryMode string `json:"victory_mode"`
+	RequireRuleApproval bool `json:"require_rule_approval"`
+	// TurnTimeout is how many seconds players get to roll before the server rolls for them, 0 for no limit
+	TurnTimeout int `json:"turn_timeout"`
+	TimeoutPenalty bool `json:"timeout_penalty"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		DiceCount: 1,
+		DiceSides: DICE_SIZE,
+		RollMode: ROLL_NORMAL,
+		DoublesRollAgain: false,
+		Battles: true,
+		MaxPlayers: 0,
+		TurnOrder: TURN_ORDER_SEATED,
+		BuiltinEffects: true,
+		VictoryMode: VICTORY_REACH,
+		RequireRuleApproval: false,
+		TurnTimeout: 0,
+		TimeoutPenalty: false,
+	}
 }
 
 type Player struct {
 	Name string `json:"name"`
 	Location string `json:"location"`
-	Conns map[*websocket.Conn]bool `json:"-"`
+	Connected bool `json:"connected"`
+	// Path is every location the player has stood on since the start, so they can be sent back along it
+	Path []string `json:"-"`
+	TokenHash string `json:"-"`
+	Conns map[*Conn]bool `json:"-"`
+}
+
+// updateConnected refreshes Connected from the live connections and reports whether it changed
+func (p *Player) updateConnected() bool {
+	connected := false
+	for conn, _ := range p.Conns {
+		if !conn.Closed() {
+			connected = true
+			break
+		}
+	}
+	changed := connected != p.Connected
+	p.Connected = connected
+	return changed
 }
 
 type LocationEffect struct {
@@ -164,6 +219,9 @@ type LocationEffect struct {
 	WormholeTarget string `json:"wormhole_target"`
 	KnockbackAmount int `json:"knockback_amount"`
 	TurnskipAmount int `json:"turnskip_amount"`
+	ModifierAmount int `json:"modifier_amount"`
+	ModifierRolls int `json:"modifier_rolls"`
+	ModifierMode string `json:"modifier_mode"`
 	FlavorText string `json:"flavor_text"`
 	Trigger string `json:"trigger"`
 }
@@ -173,6 +231,8 @@ type Location struct {
 	X int `json:"x"`
 	Y int `json:"y"`
 	Effects []*LocationEffect `json:"effects"`
+	// Next is the locations players can go on to from here. A location with none is a finish.
+	Next []string `json:"next"`
 }
 
 type GameBoard struct {
@@ -180,17 +240,10 @@ type GameBoard struct {
 	Effects []*LocationEffect `json:"effects"`
 }
 
-func (r *Room) AddEffect(name string, etype string, trigger string, locations []string, flavorText string, knockbackAmount int, wormholeTarget string, turnskipAmount int) {
+// AddEffect puts a rule in play at locations, or for the whole board without any
+func (r *Room) AddEffect(eff *LocationEffect, locations []string) {
 	g := r.Board
-	eff := &LocationEffect{
-		Type: etype,
-		FlavorText: flavorText,
-		KnockbackAmount: knockbackAmount,
-		WormholeTarget: wormholeTarget,
-		TurnskipAmount: turnskipAmount,
-		Trigger: trigger,
-		Id: uuid.New().String(),
-	}
+	eff.Id = r.newId()
 	if len(locations) == 0 {
 		g.Effects = append(g.Effects, eff)
 	} else {
@@ -208,7 +261,10 @@ func (r *Room) AddEffect(name string, etype string, trigger string, locations []
 			}
 		}
 	}
+}
 
+// CheckVictoryRule ends the round if name is the winner we were waiting on for a new rule
+func (r *Room) CheckVictoryRule(name string) {
 	// Lets check for the victory condition
 	if (len(r.InputReqs) <= 0) {
 		return
@@ -265,12 +321,16 @@ type Input struct {
 	Name string `json:"name"`
 	Value int `json:"value"`
 	Code string `json:"code"`
+	Roll *Roll `json:"roll,omitempty"`
 }
 
 type InputRequest struct {
 	Names []string `json:"names"`
 	Type string `json:"type"`
 	Received []*Input `json:"received"`
+	// Options and Remaining are the ways on and the steps left to take for a fork
+	Options []string `json:"options,omitempty"`
+	Remaining int `json:"remaining,omitempty"`
 }
 
 func (i *InputRequest) GetReceivedForName(name string) *Input {
@@ -283,33 +343,90 @@ func (i *InputRequest) GetReceivedForName(name string) *Input {
 }
 
 type Room struct {
-	sync.RWMutex
 	Code string `json:"code"`
+	Seq uint64 `json:"seq"`
 	Players []*Player `json:"players"`
 	CurrentPlayer string `json:"current_player"`
 	Board *GameBoard `json:"board"`
+	BoardId string `json:"board_id"`
+	Generated *BoardParams `json:"generated"`
 	LastUpdate time.Time `json:"last_update"`
 	InputReqs []*InputRequest `json:"input_reqs"`
 	History []string `json:"history"`
+	Events []*Event `json:"events"`
 	Settings Settings `json:"settings"`
 	TurnSkips map[string]int `json:"turn_skips"`
+	Modifiers map[string][]*RollModifier `json:"modifiers"`
 	Prompts map[string]*PromptCategory `json:"prompts"`
+	Seed int64 `json:"-"`
+	Draws uint64 `json:"-"`
+	Journal []*JournalEntry `json:"-"`
+	NeedsRecovery bool `json:"needs_recovery"`
+	RecoveryReason string `json:"recovery_reason"`
+	PendingReclaims []string `json:"pending_reclaims"`
+	Host string `json:"host"`
+	Locked bool `json:"locked"`
+	PendingRules []*PendingRule `json:"pending_rules"`
+	TurnDeadline *time.Time `json:"turn_deadline"`
+	TurnRemaining int64 `json:"turn_remaining_ms"`
+	TimerPaused bool `json:"timer_paused"`
+	Spectators int `json:"spectators"`
+
+	reclaims map[string]*seatReclaim
+	boardPkg *BoardPackage
+	spectators map[*Conn]string
+	displays map[*Conn]bool
+	display *displayState
+	rng *rand.Rand
+	promptRng *rand.Rand
+	clock time.Time
+	undos int
+	boardVersion int
+	rebuilds int
+	checkpoints []*checkpoint
+	replayed *Room
+	turnTimer *time.Timer
+	timed *InputRequest
+	timedReceived int
+	timedTimeout int
+	store RoomStore
+	cmds chan roomRequest
+	done chan struct{}
 }
 
-func newRoom(code string) *Room {
-	return &Room{
+func newRoom(code string, seed int64, pkg *BoardPackage) *Room {
+	r := &Room{
 		Code: code,
 		Players: []*Player{},
-		Board: defaultGameBoard(),
+		Board: pkg.newBoard(),
+		BoardId: pkg.Id,
+		Generated: pkg.Params,
 		LastUpdate: time.Now(),
 		InputReqs: []*InputRequest{},
 		History: []string{},
-		Settings: Settings{
-			RequireExactVictory: false,
-		},
+		Events: []*Event{},
+		Settings: defaultSettings(),
 		TurnSkips: map[string]int{},
+		Modifiers: map[string][]*RollModifier{},
 		Prompts: newPromptsMapping(),
+		PendingReclaims: []string{},
+		PendingRules: []*PendingRule{},
+		Seed: seed,
+		Journal: []*JournalEntry{},
+		reclaims: map[string]*seatReclaim{},
+		boardPkg: pkg,
+		spectators: map[*Conn]string{},
+		displays: map[*Conn]bool{},
+		display: newDisplayState(),
+	}
+	r.seedRNG()
+	// Builtin effects get their ids from the room so that replays of it match
+	for _, loc := range r.Board.Locations {
+		for _, eff := range loc.Effects {
+			eff.Id = r.newId()
+		}
 	}
+	return r
 }
 
 func (r *Room) PopInputReq() {
@@ -354,50 +471,50 @@ func (r *Room) PendingForPlayer(name string, rtype string) bool {
 
 func defaultGameBoard() *GameBoard {
 	locs := []*Location{
-		{"[1]Start", 183, 420, []*LocationEffect{}},
-		{"[2]", 105, 380, []*LocationEffect{}},
-		{"[3]", 103, 299, []*LocationEffect{}},
-		{"[4]", 163, 252, []*LocationEffect{}},
-		{"[5]Spider Hole", 224, 275, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 1, FlavorText: "The spiders scare %s back! They take a drink to settle their nerves."}}},
-		{"[6]", 265, 362, []*LocationEffect{}},
-		{"[7]Asteroids", 341, 392, []*LocationEffect{{Type: GENERIC, FlavorText: "Asteroids knock a drink into %s's mouth!"}}},
-		{"[8]", 393, 456, []*LocationEffect{}},
-		{"[9]", 411, 551, []*LocationEffect{}},
-		{"[10]Wormhole Chi-Alpha", 427, 617, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[14]Wormhole Chi-Beta", FlavorText: "The wormhole sucks %s to Wormhole Chi-Beta and a drink into their mouth!"}}},
-		{"[11]", 488, 684, []*LocationEffect{}},
-		{"[12]Spacewhale Harbor", 568, 694, []*LocationEffect{{Type: TURNSKIP, TurnskipAmount: 1, FlavorText: "%s is entranced by space whales, they skip a turn!"}}},
-		{"[13]", 621, 621, []*LocationEffect{}},
-		{"[14]Wormhole Chi-Beta", 561, 543, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[10]Wormhole Chi-Alpha", FlavorText: "The wormhole sucks %s to Wormhole Chi-Alpha and two drinks into their mouth!"}}},
-		{"[15]", 503, 486, []*LocationEffect{}},
-		{"[16]", 487, 409, []*LocationEffect{}},
-		{"[17]", 565, 347, []*LocationEffect{}},
-		{"[18]Wormhole Tau-Epsilon", 587, 267, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[23]Wormhole Tau-Gamma", FlavorText: "The wormhole sucks %s to Wormhole Tau-Gamma and a drink into their mouth!"}}},
-		{"[19]", 533, 219, []*LocationEffect{}},
-		{"[20]Asteroids", 497, 145, []*LocationEffect{{Type: GENERIC, FlavorText: "Asteroids knock a drink into %s's mouth!"}}},
-		{"[21]", 563, 108, []*LocationEffect{}},
-		{"[22]", 621, 162, []*LocationEffect{}},
-		{"[23]Wormhole Tau-Gamma", 677, 219, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[18]Wormhole Tau-Epsilon", FlavorText: "The wormhole sucks %s to Wormhole Tau-Epsilon and a drink into their mouth!"}}},
-		{"[24]", 727, 273, []*LocationEffect{}},
-		{"[25]", 678, 362, []*LocationEffect{}},
-		{"[26]The Spider House", 680, 438, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 2, FlavorText: "The spiders drag %s back! They take two drinks to settle their nerves."}}},
-		{"[27]", 714, 517, []*LocationEffect{}},
-		{"[28]", 789, 538, []*LocationEffect{}},
-		{"[29]", 880, 517, []*LocationEffect{}},
-		{"[30]", 913, 437, []*LocationEffect{}},
-		{"[31]", 851, 393, []*LocationEffect{}},
-		{"[32]Tentomon's Trove", 790, 416, []*LocationEffect{{Type: GENERIC, FlavorText: "A vicious space octopus uses all its tentacles to make %s drink eight times!"}}},
-		{"[33]", 761, 487, []*LocationEffect{}},
-		{"[34]", 775, 573, []*LocationEffect{}},
-		{"[35]Asteroids", 819, 626, []*LocationEffect{{Type: GENERIC, FlavorText: "Asteroids knock a drink into %s's mouth!"}}},
-		{"[36]", 895, 639, []*LocationEffect{}},
-		{"[37]Solar Storm", 964, 598, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 3, FlavorText: "Solar squalls push %s back! The only cure to the radiation poisoning is to take three drinks."}}},
-		{"[38]", 1000, 525, []*LocationEffect{}},
-		{"[39]", 1017, 435, []*LocationEffect{}},
-		{"[40]Solar Sail", 1019, 358, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 2, FlavorText: "Solar winds push %s back! Drink two to refill your sails."}}},
-		{"[41]", 945, 304, []*LocationEffect{}},
-		{"[42]Baby Tentomon", 880, 247, []*LocationEffect{{Type: GENERIC, FlavorText: "The space octopus child! It only has four arms to make %s drink four times"}}},
-		{"[43]", 907, 176, []*LocationEffect{}},
-		{"[44]The Restaurant at the End of the Universe", 1024, 108, []*LocationEffect{{Type: GENERIC, FlavorText: "%s made it! Have a drink and make a new rule."}}},
+		{"[1]Start", 183, 420, []*LocationEffect{}, nil},
+		{"[2]", 105, 380, []*LocationEffect{}, nil},
+		{"[3]", 103, 299, []*LocationEffect{}, nil},
+		{"[4]", 163, 252, []*LocationEffect{}, nil},
+		{"[5]Spider Hole", 224, 275, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 1, FlavorText: "The spiders scare %s back! They take a drink to settle their nerves."}}, nil},
+		{"[6]", 265, 362, []*LocationEffect{}, nil},
+		{"[7]Asteroids", 341, 392, []*LocationEffect{{Type: GENERIC, FlavorText: "Asteroids knock a drink into %s's mouth!"}}, nil},
+		{"[8]", 393, 456, []*LocationEffect{}, nil},
+		{"[9]", 411, 551, []*LocationEffect{}, nil},
+		{"[10]Wormhole Chi-Alpha", 427, 617, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[14]Wormhole Chi-Beta", FlavorText: "The wormhole sucks %s to Wormhole Chi-Beta and a drink into their mouth!"}}, nil},
+		{"[11]", 488, 684, []*LocationEffect{}, nil},
+		{"[12]Spacewhale Harbor", 568, 694, []*LocationEffect{{Type: TURNSKIP, TurnskipAmount: 1, FlavorText: "%s is entranced by space whales, they skip a turn!"}}, nil},
+		{"[13]", 621, 621, []*LocationEffect{}, nil},
+		{"[14]Wormhole Chi-Beta", 561, 543, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[10]Wormhole Chi-Alpha", FlavorText: "The wormhole sucks %s to Wormhole Chi-Alpha and two drinks into their mouth!"}}, nil},
+		{"[15]", 503, 486, []*LocationEffect{}, nil},
+		{"[16]", 487, 409, []*LocationEffect{}, nil},
+		{"[17]", 565, 347, []*LocationEffect{}, nil},
+		{"[18]Wormhole Tau-Epsilon", 587, 267, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[23]Wormhole Tau-Gamma", FlavorText: "The wormhole sucks %s to Wormhole Tau-Gamma and a drink into their mouth!"}}, nil},
+		{"[19]", 533, 219, []*LocationEffect{}, nil},
+		{"[20]Asteroids", 497, 145, []*LocationEffect{{Type: GENERIC, FlavorText: "Asteroids knock a drink into %s's mouth!"}}, nil},
+		{"[21]", 563, 108, []*LocationEffect{}, nil},
+		{"[22]", 621, 162, []*LocationEffect{}, nil},
+		{"[23]Wormhole Tau-Gamma", 677, 219, []*LocationEffect{{Type: WORMHOLE, WormholeTarget: "[18]Wormhole Tau-Epsilon", FlavorText: "The wormhole sucks %s to Wormhole Tau-Epsilon and a drink into their mouth!"}}, nil},
+		{"[24]", 727, 273, []*LocationEffect{}, nil},
+		{"[25]", 678, 362, []*LocationEffect{}, nil},
+		{"[26]The Spider House", 680, 438, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 2, FlavorText: "The spiders drag %s back! They take two drinks to settle their nerves."}}, nil},
+		{"[27]", 714, 517, []*LocationEffect{}, nil},
+		{"[28]", 789, 538, []*LocationEffect{}, nil},
+		{"[29]", 880, 517, []*LocationEffect{}, nil},
+		{"[30]", 913, 437, []*LocationEffect{}, nil},
+		{"[31]", 851, 393, []*LocationEffect{}, nil},
+		{"[32]Tentomon's Trove", 790, 416, []*LocationEffect{{Type: GENERIC, FlavorText: "A vicious space octopus uses all its tentacles to make %s drink eight times!"}}, nil},
+		{"[33]", 761, 487, []*LocationEffect{}, nil},
+		{"[34]", 775, 573, []*LocationEffect{}, nil},
+		{"[35]Asteroids", 819, 626, []*LocationEffect{{Type: GENERIC, FlavorText: "Asteroids knock a drink into %s's mouth!"}}, nil},
+		{"[36]", 895, 639, []*LocationEffect{}, nil},
+		{"[37]Solar Storm", 964, 598, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 3, FlavorText: "Solar squalls push %s back! The only cure to the radiation poisoning is to take three drinks."}}, nil},
+		{"[38]", 1000, 525, []*LocationEffect{}, nil},
+		{"[39]", 1017, 435, []*LocationEffect{}, nil},
+		{"[40]Solar Sail", 1019, 358, []*LocationEffect{{Type: KNOCKBACK, KnockbackAmount: 2, FlavorText: "Solar winds push %s back! Drink two to refill your sails."}}, nil},
+		{"[41]", 945, 304, []*LocationEffect{}, nil},
+		{"[42]Baby Tentomon", 880, 247, []*LocationEffect{{Type: GENERIC, FlavorText: "The space octopus child! It only has four arms to make %s drink four times"}}, nil},
+		{"[43]", 907, 176, []*LocationEffect{}, nil},
+		{"[44]The Restaurant at the End of the Universe", 1024, 108, []*LocationEffect{{Type: GENERIC, FlavorText: "%s made it! Have a drink and make a new rule."}}, nil},
 	}
 	for _, loc := range locs {
 		for _, eff := range loc.Effects {
@@ -405,6 +522,7 @@ func defaultGameBoard() *GameBoard {
 			eff.Trigger = BUILTIN
 		}
 	}
+	linkLocations(locs)
 	return &GameBoard{
 		Effects: []*LocationEffect{},
 		Locations: locs,
@@ -444,13 +562,25 @@ func (r *Room) DoMove(input *InputRequest) error {
 		return nil
 	}
 		
-	dice := rand.Intn(6) + 1
-	err := r.MovePlayer(input.Received[0].Name, dice, []string{}, false)
+	name := input.Received[0].Name
+	roll := r.RollFor(name)
+	input.Received[0].Value = roll.Total
+	input.Received[0].Roll = roll
+	// Done with the move before making it, as it can stop at a fork that has to come next
+	r.PopInputReq()
+	err := r.MovePlayer(name, roll.Total, []string{}, roll)
 	if err != nil {
 		return err
 	}
 
-	r.PopInputReq()
+	if r.Settings.DoublesRollAgain && roll.Doubles() {
+		r.logEvent(&Event{Type: EVENT_DOUBLES, Actor: name, Roll: roll})
+		r.InputReqs = append(r.InputReqs, &InputRequest{
+			Names: []string{name},
+			Type: MOVE,
+			Received: []*Input{},
+		})
+	}
 	return nil
 }
 
@@ -460,41 +590,111 @@ func (r *Room) DoVictory(input *InputRequest) error {
 	return nil
 }
 
-func (r *Room)MovePlayer(name string, amount int, prevLocsThisRound []string, forced bool) error {
+// MovePlayer moves a player amount steps, forward along the board or back along the path they came,
+// because of roll if they rolled for it or forced otherwise. Going forward stops at a fork until the
+// player picks which way to go on.
+func (r *Room) MovePlayer(name string, amount int, prevLocsThisRound []string, roll *Roll) error {
+	return r.movePlayer(name, amount, "", prevLocsThisRound, roll)
+}
+
+// movePlayer is MovePlayer with the first step going to via when the player just picked it at a fork
+func (r *Room) movePlayer(name string, amount int, via string, prevLocsThisRound []string, roll *Roll) error {
 	player, _ := r.GetPlayer(name)
 	if player == nil {
 		return errors.New("player not found")
 	}
+	loc, _ := r.Board.GetLocation(player.Location)
+	if loc == nil {
+		return &InvalidStateError{player.Name + " is at " + player.Location + " which does not exist"}
+	}
+	player.trackPath()
+	// visited is every location the move passes through, for the display to trace
+	visited := []string{player.Location}
+	back := func(n int) *Location {
+		for i := 1; i <= n && i < len(player.Path); i++ {
+			visited = append(visited, player.Path[len(player.Path) - 1 - i])
+		}
+		loc, _ := r.Board.GetLocation(player.stepBack(n))
+		return loc
+	}
 
-	_, lidx := r.Board.GetLocation(player.Location)
-
-	newLocIdx := lidx + amount
-	lastIdx := len(r.Board.Locations) - 1
-	if newLocIdx > lastIdx {
-		if r.Settings.RequireExactVictory {
-			newLocIdx = lastIdx - (newLocIdx - lastIdx)
-		} else {
-			newLocIdx = lastIdx
+	remaining := amount
+	for remaining > 0 && len(loc.Next) > 0 {
+		next := via
+		if next == "" {
+			if len(loc.Next) > 1 {
+				break
+			}
+			next = loc.Next[0]
+		}
+		via = ""
+		loc, _ = r.Board.GetLocation(next)
+		if loc == nil {
+			return &InvalidStateError{"the way on to " + next + " does not exist"}
 		}
+		player.Path = append(player.Path, loc.Name)
+		visited = append(visited, loc.Name)
+		remaining--
 	}
-	if newLocIdx < 0 {
-		newLocIdx = 0
+	if remaining > 0 && len(loc.Next) == 0 {
+		// Overshooting a finish bounces back off it when victory has to be exact
+		if r.Settings.VictoryMode == VICTORY_EXACT {
+			loc = back(remaining)
+		}
+		remaining = 0
 	}
-	newLocIdx = newLocIdx % len(r.Board.Locations)
-	newLoc := r.Board.Locations[newLocIdx].Name
-	if !forced {
-		r.History = append(r.History,
-			fmt.Sprintf("%s rolled a %d and moved from %s to %s", player.Name, amount, player.Location, newLoc))
-	} else {
-		r.History = append(r.History,
-			fmt.Sprintf("%s moved from %s to %s", player.Name, player.Location, newLoc))
+	if remaining < 0 {
+		loc = back(-remaining)
+		remaining = 0
+	}
+	if loc == nil {
+		return &InvalidStateError{player.Name + "'s path goes through a location which does not exist"}
+	}
+
+	newLoc := loc.Name
+	r.recordMove(player.Name, visited)
+	if roll != nil {
+		r.logEvent(&Event{Type: EVENT_ROLL, Actor: player.Name, From: player.Location, To: newLoc, Amount: amount, Roll: roll})
+	} else if amount != remaining {
+		r.logEvent(&Event{Type: EVENT_MOVE, Actor: player.Name, From: player.Location, To: newLoc, Amount: amount})
 	}
 	player.Location = newLoc
 
+	// Wait at a fork for the player to pick a way before going on
+	if remaining > 0 {
+		r.InputReqs = append([]*InputRequest{&InputRequest{
+			Names: []string{player.Name},
+			Type: FORK,
+			Received: []*Input{},
+			Options: append([]string{}, loc.Next...),
+			Remaining: remaining,
+		}}, r.InputReqs...)
+		return nil
+	}
+	return r.landPlayer(player, prevLocsThisRound)
+}
+
+// JumpPlayer moves a player straight to a location, like a wormhole does, without walking there
+func (r *Room) JumpPlayer(name string, to string, prevLocsThisRound []string) error {
+	player, _ := r.GetPlayer(name)
+	if player == nil {
+		return errors.New("player not found")
+	}
+	player.trackPath()
+
+	r.recordMove(player.Name, []string{player.Location, to})
+	r.logEvent(&Event{Type: EVENT_MOVE, Actor: player.Name, From: player.Location, To: to})
+	player.Location = to
+	player.Path = append(player.Path, to)
+	return r.landPlayer(player, prevLocsThisRound)
+}
+
+// landPlayer sets up battles with anyone where the player stopped, or does the location's effects
+func (r *Room) landPlayer(player *Player, prevLocsThisRound []string) error {
 	// Check if any other players are at the target location and set up battles if they are
 	for _,  other := range r.Players {
-		if other.Location == player.Location && other.Name != player.Name {
-			r.InputReqs = append(r.InputReqs, &InputRequest{
+		if r.Settings.Battles && other.Location == player.Location && other.Name != player.Name {
+			r.queueBattle(&InputRequest{
 				Type: BATTLE,
 				Names: []string{player.Name, other.Name},
 				Received: []*Input{},
@@ -506,6 +706,9 @@ func (r *Room)MovePlayer(name string, amount int, prevLocsThisRound []string, fo
 	if !r.PendingForPlayer(player.Name, BATTLE) {
 		prevLocsThisRound = append(prevLocsThisRound, player.Location)
 		err := r.DoEffects(player, EXTERNAL, prevLocsThisRound, false)
+		if err != nil {
+			return err
+		}
 		err = r.DoEffects(player, BUILTIN, prevLocsThisRound, false)
 		if err != nil {
 			return err
@@ -514,22 +717,41 @@ func (r *Room)MovePlayer(name string, amount int, prevLocsThisRound []string, fo
 	return nil
 }
 
+// queueBattle queues a battle ahead of any roll still to come, like the extra one for doubles, so
+// nobody moves away from a battle before it is fought
+func (r *Room) queueBattle(battle *InputRequest) {
+	idx := len(r.InputReqs)
+	for i, req := range r.InputReqs {
+		if req.Type == MOVE {
+			idx = i
+			break
+		}
+	}
+	r.InputReqs = append(r.InputReqs[:idx], append([]*InputRequest{battle}, r.InputReqs[idx:]...)...)
+}
+
 func (r *Room) DoBattle(input *InputRequest) error {
 	lastInput := input.Received[len(input.Received)-1]
-	lastInput.Value = rand.Intn(6) + 1
-	r.History = append(r.History, fmt.Sprintf("%s rolled a %d!", lastInput.Name, lastInput.Value))
+	roll := r.RollFor(lastInput.Name)
+	lastInput.Value = roll.Total
+	lastInput.Roll = roll
+	r.logEvent(&Event{Type: EVENT_BATTLE_ROLL, Actor: lastInput.Name, Amount: roll.Total, Roll: roll})
 
 	// Return if we don't have all the inputs we're waiting for
 	if len(input.Received) != len(input.Names) {
 		return nil
 	}
 
-	// Panic if the players are not in the same place, invalid game state
+	// Bail out if the players are not in the same place, invalid game state
 	playerOne, _ := r.GetPlayer(input.Names[0])
 	playerTwo, _ := r.GetPlayer(input.Names[1])
 
-	if (playerOne == nil || playerTwo == nil || playerOne.Location != playerTwo.Location) {
-		log.Fatalln("Invalid game state during battle with", playerOne, playerTwo)
+	if playerOne == nil || playerTwo == nil {
+		return &InvalidStateError{fmt.Sprintf("battle between %s and %s is missing a player", input.Names[0], input.Names[1])}
+	}
+	if playerOne.Location != playerTwo.Location {
+		return &InvalidStateError{fmt.Sprintf("battle between %s at %s and %s at %s who are not in the same place",
+			playerOne.Name, playerOne.Location, playerTwo.Name, playerTwo.Location)}
 	}
 
 	rollOne := input.GetReceivedForName(playerOne.Name).Value
@@ -554,7 +776,7 @@ func (r *Room) DoBattle(input *InputRequest) error {
 	}
 
 	if diff == 0 {
-		r.History = append(r.History, "Battle was a tie!")
+		r.logEvent(&Event{Type: EVENT_BATTLE_RESULT, Actor: playerOne.Name, Target: playerTwo.Name})
 		r.PopInputReq()
 		r.InputReqs = append([]*InputRequest{&InputRequest{
 			Names: []string{playerOne.Name, playerTwo.Name},
@@ -563,6 +785,7 @@ func (r *Room) DoBattle(input *InputRequest) error {
 		}}, r.InputReqs...)
 		return nil
 	} else {
+		r.logEvent(&Event{Type: EVENT_BATTLE_RESULT, Actor: winner.Name, Target: loser.Name, Amount: -diff})
 		err = r.DoEffects(winner, ONBATTLEWIN, []string{winner.Location}, true)
 		if err != nil {
 			return err
@@ -576,11 +799,17 @@ func (r *Room) DoBattle(input *InputRequest) error {
 	r.ClearPendingForPlayer(loser.Name)
 	r.PopInputReq()
 
-	r.MovePlayer(loser.Name, diff, []string{}, true)
+	err = r.MovePlayer(loser.Name, diff, []string{}, nil)
+	if err != nil {
+		return err
+	}
 	if winner.Name == playerOne.Name {
 		// If there's no more battles for playerOne, apply effects
  		if !r.PendingForPlayer(winner.Name, BATTLE) {
 			err = r.DoEffects(playerOne, EXTERNAL, []string{winner.Location}, false)
+			if err != nil {
+				return err
+			}
 			err = r.DoEffects(playerOne, BUILTIN, []string{winner.Location}, false)
 			if err != nil {
 				return err
@@ -592,9 +821,13 @@ func (r *Room) DoBattle(input *InputRequest) error {
 }
 
 func (r *Room) DoEffects(p *Player, triggerType string, prevLocsThisRound []string, generic bool) error {
-	location, lidx := r.Board.GetLocation(p.Location)
+	if triggerType == BUILTIN && !r.Settings.BuiltinEffects {
+		return nil
+	}
+
+	location, _ := r.Board.GetLocation(p.Location)
 	if location == nil {
-		return errors.New(p.Location + " did not exist")
+		return &InvalidStateError{p.Name + " is at " + p.Location + " which does not exist"}
 	}
 
 	haveVisited := func(visitTarget string)bool{
@@ -606,7 +839,7 @@ func (r *Room) DoEffects(p *Player, triggerType string, prevLocsThisRound []stri
 		return false
 	}
 
-	deferred_move_diff := 0
+	var deferredMove func() error
 
 	targetList := location.Effects
 	if generic {
@@ -618,51 +851,76 @@ func (r *Room) DoEffects(p *Player, triggerType string, prevLocsThisRound []stri
 		}
 		switch effect.Type {
 		case WORMHOLE:
-			if deferred_move_diff != 0 {
+			if deferredMove != nil {
 				continue
 			}
-			target, tidx := r.Board.GetLocation(effect.WormholeTarget)
+			target, _ := r.Board.GetLocation(effect.WormholeTarget)
 			if target == nil {
-				return errors.New(effect.WormholeTarget + "did not exist for wormhole")
+				return &InvalidStateError{effect.WormholeTarget + " did not exist for wormhole"}
 			}
 			if haveVisited(effect.WormholeTarget) {
 				continue
 			}
-			diff := tidx - lidx
-			r.History = append(r.History, fmt.Sprintf(effect.FlavorText, p.Name))
-			deferred_move_diff = diff
+			r.logEffect(p, effect)
+			deferredMove = func() error {
+				return r.JumpPlayer(p.Name, target.Name, prevLocsThisRound)
+			}
 		case KNOCKBACK:
-			if deferred_move_diff != 0 {
+			if deferredMove != nil {
 				continue
 			}
-			tidx := lidx - effect.KnockbackAmount
-			lastIdx := len(r.Board.Locations) - 1
-			if tidx > lastIdx {
-				tidx = lastIdx - (tidx - lastIdx)
+			// Knockbacks go back along the player's path, or forward if the amount is negative
+			amount := effect.KnockbackAmount
+			target := p.pathBack(amount)
+			if amount < 0 {
+				target = r.Board.aheadOf(p.Location, -amount)
 			}
-			if tidx < 0 {
-				tidx = 0
-			}
-			diff := tidx - lidx
-			target := r.Board.Locations[tidx]
-			if haveVisited(target.Name) {
+			if target == p.Location || haveVisited(target) {
 				continue
 			}
-			r.History = append(r.History, fmt.Sprintf(effect.FlavorText, p.Name))
-			deferred_move_diff = diff
+			r.logEffect(p, effect)
+			deferredMove = func() error {
+				return r.MovePlayer(p.Name, -amount, prevLocsThisRound, nil)
+			}
 		case TURNSKIP:
 			r.TurnSkips[p.Name] = r.TurnSkips[p.Name] + effect.TurnskipAmount
-			r.History = append(r.History, fmt.Sprintf(effect.FlavorText, p.Name))
+			r.logEffect(p, effect)
+		case MODIFIER:
+			r.AddModifier(p.Name, &RollModifier{
+				Amount: effect.ModifierAmount,
+				Mode: effect.ModifierMode,
+				Rolls: effect.ModifierRolls,
+			})
+			r.logEffect(p, effect)
 		case GENERIC:
-			r.History = append(r.History, fmt.Sprintf(effect.FlavorText, p.Name))
+			r.logEffect(p, effect)
 		default:
-			return errors.New("Hit default case in effects switch")
+			return &InvalidStateError{"unknown effect type " + effect.Type}
 		}
 	}
-	if deferred_move_diff == 0 {
+	if deferredMove == nil {
 		return nil
 	} else {
-		return r.MovePlayer(p.Name, deferred_move_diff, prevLocsThisRound, true)
+		return deferredMove()
+	}
+}
+
+// StartTurnFrom gives the turn to the first player from seat idx onward who isn't skipping it
+func (r *Room) StartTurnFrom(idx int) {
+	for {
+		r.CurrentPlayer = r.Players[idx % len(r.Players)].Name
+		idx++
+		if r.TurnSkips[r.CurrentPlayer] > 0 {
+			r.TurnSkips[r.CurrentPlayer] = r.TurnSkips[r.CurrentPlayer] - 1
+			r.logEvent(&Event{Type: EVENT_TURN_SKIPPED, Actor: r.CurrentPlayer, Amount: r.TurnSkips[r.CurrentPlayer]})
+			continue
+		}
+		r.InputReqs = append(r.InputReqs, &InputRequest{
+			Names: []string{r.CurrentPlayer},
+			Type: MOVE,
+			Received: []*Input{},
+		})
+		break
 	}
 }
 
@@ -672,19 +930,30 @@ func (r *Room) AdvanceRoomState(input *Input) (bool, error) {
 		return false, errors.New("empty lobby")
 	}
 
+	// Bail out if the game is broken until someone repairs it
+	if r.NeedsRecovery {
+		return false, errors.New("game needs to be repaired before it can continue")
+	}
+
 	// Bail out if we're starting a new game
 	if len(r.InputReqs) == 0 {
+		if r.Settings.TurnOrder == TURN_ORDER_RANDOM {
+			r.rng.Shuffle(len(r.Players), func(i, j int) {
+				r.Players[i], r.Players[j] = r.Players[j], r.Players[i]
+			})
+		}
 		r.InputReqs = append(r.InputReqs, &InputRequest{
 			Names: []string{r.Players[0].Name},
 			Received: []*Input{},
 			Type: MOVE,
 		})
-		r.History = append(r.History, input.Name + " started a new game")
+		r.logEvent(&Event{Type: EVENT_GAME_STARTED, Actor: input.Name})
 		r.CurrentPlayer = r.Players[0].Name
 		r.LastUpdate = time.Now()
 
 		for _, player := range r.Players {
 			player.Location = r.Board.Locations[0].Name
+			player.Path = []string{player.Location}
 		}
 		return true, nil
 	}
@@ -704,6 +973,11 @@ func (r *Room) AdvanceRoomState(input *Input) (bool, error) {
 		}
 	}
 
+	// Bail out if a fork is given a way that isn't one of its options
+	if inputReq.Type == FORK && (input.Value < 0 || input.Value >= len(inputReq.Options)) {
+		return false, errors.New("no such way on")
+	}
+
 	// Add the input otherwise
 	inputReq.Received = append(inputReq.Received, input)
 	defer func(){
@@ -717,17 +991,19 @@ func (r *Room) AdvanceRoomState(input *Input) (bool, error) {
 		err = r.DoMove(inputReq)
 	case BATTLE:
 		err = r.DoBattle(inputReq)
+	case FORK:
+		err = r.DoFork(inputReq)
 	case VICTORY:
 		err = r.DoVictory(inputReq)
 		return true, err
 	default:
-		return true, errors.New("Hit default case in input request switch")
+		return true, &InvalidStateError{"unknown input request type " + inputReq.Type}
 	}
 
 	// Do win conditions here
 	for _, player := range r.Players {
-		if player.Location == r.Board.Locations[len(r.Board.Locations) - 1].Name {
-			r.History = append(r.History, fmt.Sprintf("%s won the round!", player.Name))
+		if r.Board.IsFinish(player.Location) {
+			r.logEvent(&Event{Type: EVENT_VICTORY, Actor: player.Name, To: player.Location})
 			r.InputReqs = []*InputRequest{&InputRequest{
 				Names: []string{player.Name},
 				Type: VICTORY,
@@ -738,24 +1014,11 @@ func (r *Room) AdvanceRoomState(input *Input) (bool, error) {
 
 	// If input reqs is empty push to the next player
 	if len(r.InputReqs) == 0 {
-		for {
-			p, pidx := r.GetPlayer(r.CurrentPlayer)
-			if (p == nil) {
-				log.Fatalln("Expected", r.CurrentPlayer, "to exist")
-			}
-			r.CurrentPlayer = r.Players[(pidx + 1) % len(r.Players)].Name
-			if r.TurnSkips[r.CurrentPlayer] > 0 {
-				r.TurnSkips[r.CurrentPlayer] = r.TurnSkips[r.CurrentPlayer] - 1
-				r.History = append(r.History, fmt.Sprintf("Skipped %s's turn", r.CurrentPlayer))
-				continue
-			}
-			r.InputReqs = append(r.InputReqs, &InputRequest{
-				Names: []string{r.CurrentPlayer},
-				Type: MOVE,
-				Received: []*Input{},
-			})
-			break
+		p, pidx := r.GetPlayer(r.CurrentPlayer)
+		if (p == nil) {
+			return true, &InvalidStateError{"expected current player " + r.CurrentPlayer + " to exist"}
 		}
+		r.StartTurnFrom(pidx + 1)
 	}
 	return true, err
 }
\ No newline at end of file
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+const (
+	GENERATED_BOARD = "generated"
+	THEME_BLANK = "BLANK"
+	THEME_SPACE = "SPACE"
+	MIN_BOARD_LENGTH = 10
+	MAX_BOARD_LENGTH = 200
+	MAX_DIFFICULTY = 5
+	GENERATED_WIDTH = 1200
+	GENERATED_HEIGHT = 800
+	GENERATE_ATTEMPTS = 20
+)
+
+// BoardParams is what the generator builds a board from. The densities are the share of locations
+// between the start and the finish that get each kind of effect.
+type BoardParams struct {
+	Seed int64 `json:"seed"`
+	Length int `json:"length"`
+	Knockbacks float64 `json:"knockbacks"`
+	Turnskips float64 `json:"turnskips"`
+	Modifiers float64 `json:"modifiers"`
+	Generics float64 `json:"generics"`
+	Wormholes int `json:"wormholes"`
+	Difficulty int `json:"difficulty"`
+	Theme string `json:"theme"`
+}
+
+func defaultBoardParams() BoardParams {
+	return BoardParams{
+		Length: 44,
+		Knockbacks: .1,
+		Turnskips: .03,
+		Modifiers: .05,
+		Generics: .15,
+		Wormholes: 2,
+		Difficulty: 2,
+		Theme: THEME_SPACE,
+	}
+}
+
+// Validate checks the generator can build a board from the params
+func (p *BoardParams) Validate() error {
+	if p.Length < MIN_BOARD_LENGTH || p.Length > MAX_BOARD_LENGTH {
+		return fmt.Errorf("length must be between %d and %d", MIN_BOARD_LENGTH, MAX_BOARD_LENGTH)
+	}
+	densities := []float64{p.Knockbacks, p.Turnskips, p.Modifiers, p.Generics}
+	total := 0.0
+	for _, density := range densities {
+		if density < 0 || density > 1 {
+			return errors.New("effect densities must be between 0 and 1")
+		}
+		total += density
+	}
+	if p.Wormholes < 0 {
+		return errors.New("wormholes can't be negative")
+	}
+	slots := p.Length - 2
+	if effectCount(total, slots) + 2 * p.Wormholes > slots {
+		return errors.New("there are more effects and wormholes than locations to put them on")
+	}
+	if p.Difficulty < 1 || p.Difficulty > MAX_DIFFICULTY {
+		return fmt.Errorf("difficulty must be between 1 and %d", MAX_DIFFICULTY)
+	}
+	switch p.Theme {
+	case THEME_BLANK, THEME_SPACE:
+	default:
+		return errors.New("unknown theme " + p.Theme)
+	}
+	return nil
+}
+
+func effectCount(density float64, slots int) int {
+	return int(math.Round(density * float64(slots)))
+}
+
+// times is n of something for flavor text, like "a drink" or "3 drinks"
+func times(n int, what string) string {
+	if n == 1 {
+		return "a " + what
+	}
+	return fmt.Sprintf("%d %ss", n, what)
+}
+
+var generatedNames = map[string][]string{
+	KNOCKBACK: {"Spider Hole", "Solar Storm", "Solar Sail", "Gravity Well", "Meteor Shower", "Space Pirates"},
+	TURNSKIP: {"Spacewhale Harbor", "Time Dilation", "Customs Checkpoint", "Space Traffic"},
+	MODIFIER: {"Ion Storm", "Low Gravity", "Nebula Fog", "Warp Drive"},
+	GENERIC: {"Asteroids", "Space Bar", "Comet Tail", "Moon Base", "Tentomon's Trove"},
+}
+
+var wormholeNames = []string{"Chi", "Tau", "Sigma", "Omega", "Delta", "Psi", "Phi", "Rho", "Kappa", "Lambda"}
+
+// GenerateBoard builds a new board from params. The same params always build the same board, so rooms
+// only need to keep the params to rebuild it.
+func GenerateBoard(params BoardParams) (*BoardPackage, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(params.Seed))
+
+	var locs []*Location
+	var err error
+	for attempt := 0; attempt < GENERATE_ATTEMPTS; attempt++ {
+		locs = generateLocations(params, rng)
+		if err = ValidateBoard(locs); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.New("could not generate a playable board: " + err.Error())
+	}
+
+	img, err := generateBackground(params, rng)
+	if err != nil {
+		return nil, err
+	}
+	stored := params
+	return &BoardPackage{
+		Id: GENERATED_BOARD,
+		Name: fmt.Sprintf("Generated board %d", params.Seed),
+		Locations: locs,
+		Image: img,
+		ImageType: "image/png",
+		Params: &stored,
+	}, nil
+}
+
+// generateLocations snakes the locations back and forth across the board and scatters effects over
+// the ones between the start and the finish
+func generateLocations(params BoardParams, rng *rand.Rand) []*Location {
+	n := params.Length
+	cols := int(math.Ceil(math.Sqrt(float64(n) * GENERATED_WIDTH / GENERATED_HEIGHT)))
+	rows := (n + cols - 1) / cols
+	margin := 60
+	dx := (GENERATED_WIDTH - 2 * margin) / (cols - 1)
+	dy := (GENERATED_HEIGHT - 2 * margin) / int(math.Max(float64(rows - 1), 1))
+
+	locs := []*Location{}
+	for idx := 0; idx < n; idx++ {
+		row, col := idx / cols, idx % cols
+		if row % 2 == 1 {
+			col = cols - 1 - col
+		}
+		locs = append(locs, &Location{
+			X: margin + col * dx + rng.Intn(dx / 3 + 1) - dx / 6,
+			Y: margin + row * dy + rng.Intn(dy / 3 + 1) - dy / 6,
+			Effects: []*LocationEffect{},
+		})
+	}
+
+	labels := make([]string, n)
+	labels[0], labels[n - 1] = "Start", "Finish"
+	slots := rng.Perm(n - 2)
+	take := func() int {
+		idx := slots[0] + 1
+		slots = slots[1:]
+		return idx
+	}
+
+	pairs := [][2]int{}
+	for pair := 0; pair < params.Wormholes; pair++ {
+		a, b := take(), take()
+		name := wormholeNames[pair % len(wormholeNames)]
+		if pair >= len(wormholeNames) {
+			name = fmt.Sprintf("%s %d", name, pair / len(wormholeNames) + 1)
+		}
+		labels[a], labels[b] = "Wormhole " + name + "-Alpha", "Wormhole " + name + "-Beta"
+		pairs = append(pairs, [2]int{a, b})
+	}
+
+	drinks := func() string {
+		return times(1 + rng.Intn(params.Difficulty), "drink")
+	}
+	place := func(effType string, density float64, build func(idx int) *LocationEffect) {
+		for i := effectCount(density, n - 2); i > 0 && len(slots) > 0; i-- {
+			idx := take()
+			names := generatedNames[effType]
+			labels[idx] = names[rng.Intn(len(names))]
+			locs[idx].Effects = append(locs[idx].Effects, build(idx))
+		}
+	}
+	place(KNOCKBACK, params.Knockbacks, func(idx int) *LocationEffect {
+		amount := 1 + rng.Intn(params.Difficulty)
+		if amount > idx {
+			amount = idx
+		}
+		return &LocationEffect{Type: KNOCKBACK, KnockbackAmount: amount,
+			FlavorText: fmt.Sprintf("%%s is pushed back %d and takes %s to recover!", amount, times(amount, "drink"))}
+	})
+	place(TURNSKIP, params.Turnskips, func(idx int) *LocationEffect {
+		amount := 1 + params.Difficulty / 4
+		return &LocationEffect{Type: TURNSKIP, TurnskipAmount: amount,
+			FlavorText: fmt.Sprintf("%%s is stuck here for %s, have a drink while you wait", times(amount, "turn"))}
+	})
+	place(MODIFIER, params.Modifiers, func(idx int) *LocationEffect {
+		if rng.Intn(MAX_DIFFICULTY) < params.Difficulty {
+			return &LocationEffect{Type: MODIFIER, ModifierMode: ROLL_DISADVANTAGE, ModifierRolls: 1,
+				FlavorText: "%s's next roll is with disadvantage, drink to steady your hand"}
+		}
+		return &LocationEffect{Type: MODIFIER, ModifierMode: ROLL_ADVANTAGE, ModifierRolls: 1,
+			FlavorText: "%s's next roll is with advantage, everyone else drinks"}
+	})
+	place(GENERIC, params.Generics, func(idx int) *LocationEffect {
+		return &LocationEffect{Type: GENERIC, FlavorText: fmt.Sprintf("%%s takes %s!", drinks())}
+	})
+
+	for idx, loc := range locs {
+		loc.Name = fmt.Sprintf("[%d]%s", idx + 1, labels[idx])
+	}
+	// Each end of a wormhole pair sends players to the other end
+	for _, pair := range pairs {
+		for end := 0; end < 2; end++ {
+			from, to := pair[end], pair[1 - end]
+			locs[from].Effects = append(locs[from].Effects, &LocationEffect{Type: WORMHOLE, WormholeTarget: locs[to].Name,
+				FlavorText: fmt.Sprintf("The wormhole sucks %%s to %s and %s into their mouth!", labels[to], drinks())})
+		}
+	}
+
+	for _, loc := range locs {
+		for _, eff := range loc.Effects {
+			eff.Trigger = BUILTIN
+		}
+	}
+	linkLocations(locs)
+	return locs
+}
+
+// generateBackground draws the picture the board is laid over, a starfield with a few planets for the
+// space theme or nothing at all for the blank one
+func generateBackground(params BoardParams, rng *rand.Rand) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, GENERATED_WIDTH, GENERATED_HEIGHT))
+	fill := func(c color.RGBA, inside func(x, y int) bool) {
+		for y := 0; y < GENERATED_HEIGHT; y++ {
+			for x := 0; x < GENERATED_WIDTH; x++ {
+				if inside(x, y) {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+
+	if params.Theme == THEME_BLANK {
+		fill(color.RGBA{240, 240, 235, 255}, func(x, y int) bool { return true })
+	} else {
+		fill(color.RGBA{8, 10, 30, 255}, func(x, y int) bool { return true })
+		for planet := 3 + rng.Intn(4); planet > 0; planet-- {
+			cx, cy, radius := rng.Intn(GENERATED_WIDTH), rng.Intn(GENERATED_HEIGHT), 20 + rng.Intn(50)
+			c := color.RGBA{uint8(60 + rng.Intn(150)), uint8(40 + rng.Intn(120)), uint8(60 + rng.Intn(150)), 255}
+			fill(c, func(x, y int) bool {
+				return (x - cx) * (x - cx) + (y - cy) * (y - cy) <= radius * radius
+			})
+		}
+		for star := GENERATED_WIDTH * GENERATED_HEIGHT / 600; star > 0; star-- {
+			b := uint8(120 + rng.Intn(136))
+			img.SetRGBA(rng.Intn(GENERATED_WIDTH), rng.Intn(GENERATED_HEIGHT), color.RGBA{b, b, b, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runGenerate is the generate subcommand. It writes a generated board into a board directory so it
+// can be tweaked by hand and added to BOARDS_DIR.
+func runGenerate(args []string) int {
+	params := defaultBoardParams()
+	flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+	flags.Int64Var(&params.Seed, "seed", newSeed(), "seed to generate the board from")
+	flags.IntVar(&params.Length, "length", params.Length, "number of locations")
+	flags.Float64Var(&params.Knockbacks, "knockbacks", params.Knockbacks, "share of locations with a knockback")
+	flags.Float64Var(&params.Turnskips, "turnskips", params.Turnskips, "share of locations that skip turns")
+	flags.Float64Var(&params.Modifiers, "modifiers", params.Modifiers, "share of locations that change the next roll")
+	flags.Float64Var(&params.Generics, "generics", params.Generics, "share of locations that just make you drink")
+	flags.IntVar(&params.Wormholes, "wormholes", params.Wormholes, "number of wormhole pairs")
+	flags.IntVar(&params.Difficulty, "difficulty", params.Difficulty, fmt.Sprintf("difficulty from 1 to %d", MAX_DIFFICULTY))
+	flags.StringVar(&params.Theme, "theme", params.Theme, "background theme, SPACE or BLANK")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: server generate [flags] <board dir>")
+		return 2
+	}
+	dir := flags.Arg(0)
+
+	pkg, err := GenerateBoard(params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	manifest, err := json.MarshalIndent(&boardManifest{Name: pkg.Name, Image: "background.png", Locations: pkg.Locations}, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "background.png"), pkg.Image, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, BOARD_MANIFEST), manifest, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println("Generated", pkg.Name, "in", dir)
+	return 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGeneratedBoardsAreValid(t *testing.T) {
+	params := func(edit func(p *BoardParams)) BoardParams {
+		p := defaultBoardParams()
+		edit(&p)
+		return p
+	}
+
+	tests := []struct {
+		name string
+		params BoardParams
+	}{
+		{"defaults", defaultBoardParams()},
+		{"shortest", params(func(p *BoardParams) { p.Length = MIN_BOARD_LENGTH; p.Wormholes = 0 })},
+		{"longest", params(func(p *BoardParams) { p.Length = MAX_BOARD_LENGTH })},
+		{"no effects", params(func(p *BoardParams) { p.Knockbacks, p.Turnskips, p.Modifiers, p.Generics, p.Wormholes = 0, 0, 0, 0, 0 })},
+		{"crowded", params(func(p *BoardParams) { p.Knockbacks, p.Turnskips, p.Modifiers, p.Generics = .3, .1, .1, .2 })},
+		{"many wormholes", params(func(p *BoardParams) { p.Wormholes = 8 })},
+		{"easiest", params(func(p *BoardParams) { p.Difficulty = 1 })},
+		{"hardest", params(func(p *BoardParams) { p.Difficulty = MAX_DIFFICULTY; p.Knockbacks = .3 })},
+		{"blank theme", params(func(p *BoardParams) { p.Theme = THEME_BLANK })},
+	}
+
+	for _, tt := range tests {
+		for seed := int64(1); seed <= 5; seed++ {
+			p := tt.params
+			p.Seed = seed
+			pkg, err := GenerateBoard(p)
+			if err != nil {
+				t.Errorf("%s seed %d: %s", tt.name, seed, err.Error())
+				continue
+			}
+			board := pkg.newBoard()
+			if len(board.Locations) != p.Length {
+				t.Errorf("%s seed %d: %d locations, want %d", tt.name, seed, len(board.Locations), p.Length)
+			}
+			if err := ValidateBoard(board.Locations); err != nil {
+				t.Errorf("%s seed %d: generated board is invalid: %s", tt.name, seed, err.Error())
+			}
+
+			// The params alone have to be enough to build the same board again
+			if seed > 1 {
+				continue
+			}
+			again, err := GenerateBoard(p)
+			if err != nil {
+				t.Errorf("%s seed %d: second build failed: %s", tt.name, seed, err.Error())
+				continue
+			}
+			first, _ := json.Marshal(board)
+			second, _ := json.Marshal(again.newBoard())
+			if string(first) != string(second) {
+				t.Errorf("%s seed %d: the same params built different boards", tt.name, seed)
+			}
+		}
+	}
+}
+
+func TestGenerateBoardRejectsBadParams(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(p *BoardParams)
+	}{
+		{"too short", func(p *BoardParams) { p.Length = MIN_BOARD_LENGTH - 1 }},
+		{"too long", func(p *BoardParams) { p.Length = MAX_BOARD_LENGTH + 1 }},
+		{"negative density", func(p *BoardParams) { p.Generics = -.1 }},
+		{"density over one", func(p *BoardParams) { p.Knockbacks = 1.5 }},
+		{"negative wormholes", func(p *BoardParams) { p.Wormholes = -1 }},
+		{"more effects than locations", func(p *BoardParams) { p.Knockbacks, p.Generics = .6, .5 }},
+		{"too many wormholes", func(p *BoardParams) { p.Wormholes = p.Length }},
+		{"no difficulty", func(p *BoardParams) { p.Difficulty = 0 }},
+		{"too difficult", func(p *BoardParams) { p.Difficulty = MAX_DIFFICULTY + 1 }},
+		{"unknown theme", func(p *BoardParams) { p.Theme = "JUNGLE" }},
+	}
+
+	for _, tt := range tests {
+		p := defaultBoardParams()
+		tt.edit(&p)
+		if _, err := GenerateBoard(p); err == nil {
+			t.Errorf("%s: generated a board, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+const (
+	FORK = "FORK"
+)
+
+// linkLocations joins up a board that doesn't give any edges into a single track in the order its
+// locations are listed, which is how every board was laid out before they could branch
+func linkLocations(locations []*Location) {
+	linked := false
+	for _, loc := range locations {
+		if loc.Next == nil {
+			loc.Next = []string{}
+		}
+		if len(loc.Next) > 0 {
+			linked = true
+		}
+	}
+	if linked {
+		return
+	}
+	for idx := 0; idx < len(locations) - 1; idx++ {
+		locations[idx].Next = []string{locations[idx + 1].Name}
+	}
+}
+
+// IsFinish is whether name is a location with no way on, which wins the game for whoever lands there
+func (b *GameBoard) IsFinish(name string) bool {
+	loc, _ := b.GetLocation(name)
+	return loc != nil && len(loc.Next) == 0
+}
+
+// aheadOf is where walking n steps forward from name ends up without any choices, stopping early
+// at a fork or a finish
+func (b *GameBoard) aheadOf(name string, n int) string {
+	loc, _ := b.GetLocation(name)
+	for ; loc != nil && n > 0 && len(loc.Next) == 1; n-- {
+		next, _ := b.GetLocation(loc.Next[0])
+		if next == nil {
+			break
+		}
+		loc = next
+	}
+	if loc == nil {
+		return name
+	}
+	return loc.Name
+}
+
+// trackPath starts the player's path over from where they are if it has lost track of them
+func (p *Player) trackPath() {
+	if len(p.Path) == 0 || p.Path[len(p.Path) - 1] != p.Location {
+		p.Path = []string{p.Location}
+	}
+}
+
+// pathBack is where stepping back n along the player's path would take them, never past where it starts
+func (p *Player) pathBack(n int) string {
+	p.trackPath()
+	if n > len(p.Path) - 1 {
+		n = len(p.Path) - 1
+	}
+	return p.Path[len(p.Path) - 1 - n]
+}
+
+// stepBack takes the player's path back n steps and returns where that leaves them. It works on the
+// path as it is, since partway through a move the path already runs past the player's location.
+func (p *Player) stepBack(n int) string {
+	if n > len(p.Path) - 1 {
+		n = len(p.Path) - 1
+	}
+	p.Path = p.Path[:len(p.Path) - n]
+	return p.Path[len(p.Path) - 1]
+}
+
+// DoFork sends the player the way they picked and on for whatever is left of their move
+func (r *Room) DoFork(input *InputRequest) error {
+	choice := input.Received[0]
+	r.PopInputReq()
+	return r.movePlayer(choice.Name, input.Remaining, input.Options[choice.Value], []string{}, nil)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrNotHost = errors.New("only the host can do that")
+
+// PendingRule is a rule proposed by a player that waits for the host to approve or veto it
+type PendingRule struct {
+	Id string `json:"id"`
+	Proposer string `json:"proposer"`
+	Rule *RuleCmd `json:"rule"`
+}
+
+// requireHost errors unless name is the room host
+func (r *Room) requireHost(name string) error {
+	if r.Host == "" || r.Host != name {
+		return ErrNotHost
+	}
+	return nil
+}
+
+// handOverHost passes hosting to the next connected player after the current host, if any
+func (r *Room) handOverHost() bool {
+	_, hidx := r.GetPlayer(r.Host)
+	for i := 1; i <= len(r.Players); i++ {
+		candidate := r.Players[(hidx + i) % len(r.Players)]
+		if candidate.Name != r.Host && candidate.Connected {
+			r.logEvent(&Event{Type: EVENT_HOST_CHANGED, Target: candidate.Name})
+			r.Host = candidate.Name
+			return true
+		}
+	}
+	return false
+}
+
+// HostCmd runs Cmd only if Name is the room host
+type HostCmd struct {
+	Name string
+	Cmd Command
+}
+
+func (c *HostCmd) Apply(r *Room) (interface{}, bool, error) {
+	if err := r.requireHost(c.Name); err != nil {
+		return nil, false, err
+	}
+	return c.Cmd.Apply(r)
+}
+
+// KickCmd removes a player from the room
+type KickCmd struct {
+	Name string
+	Target string
+}
+
+func (c *KickCmd) Apply(r *Room) (interface{}, bool, error) {
+	if c.Target == c.Name {
+		return nil, false, errors.New("the host can't kick themselves")
+	}
+	if player, _ := r.GetPlayer(c.Target); player == nil {
+		return nil, false, errors.New("no such player")
+	}
+	r.logEvent(&Event{Type: EVENT_KICK, Actor: c.Name, Target: c.Target})
+	if err := r.RemovePlayer(c.Target); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// TransferHostCmd makes another player the host
+type TransferHostCmd struct {
+	Name string
+	Target string
+}
+
+func (c *TransferHostCmd) Apply(r *Room) (interface{}, bool, error) {
+	if player, _ := r.GetPlayer(c.Target); player == nil {
+		return nil, false, errors.New("no such player")
+	}
+	r.Host = c.Target
+	r.logEvent(&Event{Type: EVENT_HOST_CHANGED, Actor: c.Name, Target: c.Target})
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+// LockCmd stops or allows new players joining
+type LockCmd struct {
+	Name string
+	Locked bool
+}
+
+func (c *LockCmd) Apply(r *Room) (interface{}, bool, error) {
+	if r.Locked == c.Locked {
+		return nil, false, nil
+	}
+	r.Locked = c.Locked
+	if c.Locked {
+		r.logEvent(&Event{Type: EVENT_LOCKED, Actor: c.Name})
+	} else {
+		r.logEvent(&Event{Type: EVENT_UNLOCKED, Actor: c.Name})
+	}
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+// RestartCmd sends everyone back to the start and waits for a new game to begin. Rules are kept.
+type RestartCmd struct {
+	Name string
+}
+
+func (c *RestartCmd) Apply(r *Room) (interface{}, bool, error) {
+	for _, player := range r.Players {
+		player.Location = r.Board.Locations[0].Name
+		player.Path = []string{player.Location}
+	}
+	r.InputReqs = []*InputRequest{}
+	r.TurnSkips = map[string]int{}
+	r.Modifiers = map[string][]*RollModifier{}
+	r.CurrentPlayer = ""
+	r.NeedsRecovery = false
+	r.RecoveryReason = ""
+	r.logEvent(&Event{Type: EVENT_RESTARTED, Actor: c.Name})
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+// ModerateRuleCmd approves or vetoes a pending rule. Vetoing a rule already in play removes it.
+type ModerateRuleCmd struct {
+	Name string
+	Id string
+	Approve bool
+}
+
+func (c *ModerateRuleCmd) Apply(r *Room) (interface{}, bool, error) {
+	nPending := []*PendingRule{}
+	var found *PendingRule
+	for _, pending := range r.PendingRules {
+		if pending.Id == c.Id {
+			found = pending
+		} else {
+			nPending = append(nPending, pending)
+		}
+	}
+
+	if found == nil {
+		if c.Approve {
+			return nil, false, errors.New("no such pending rule")
+		}
+		r.RemoveEffect(c.Id)
+		r.logEvent(&Event{Type: EVENT_RULE_VETOED, Actor: c.Name, EffectId: c.Id})
+		r.LastUpdate = time.Now()
+		return nil, true, nil
+	}
+
+	r.PendingRules = nPending
+	if c.Approve {
+		rule := found.Rule
+		// The rule already counted for the victory it was proposed for, so approving it later never ends a round
+		r.AddEffect(rule.effect(), rule.Locations)
+		r.logEvent(&Event{Type: EVENT_RULE_APPROVED, Actor: c.Name, Target: found.Proposer, EffectType: rule.Type})
+	} else {
+		r.logEvent(&Event{Type: EVENT_RULE_VETOED, Actor: c.Name, Target: found.Proposer, EffectType: found.Rule.Type})
+	}
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+// proposeRule holds a rule for the host to approve. A winner proposing their rule still ends the round.
+func (r *Room) proposeRule(rule *RuleCmd) {
+	r.PendingRules = append(r.PendingRules, &PendingRule{
+		Id: r.newId(),
+		Proposer: rule.Name,
+		Rule: rule,
+	})
+	r.logEvent(&Event{Type: EVENT_RULE_PROPOSED, Actor: rule.Name, EffectType: rule.Type})
+	r.CheckVictoryRule(rule.Name)
+}
+
+// HostReq covers the fields of every host endpoint, each of which only reads the ones it needs
+type HostReq struct {
+	Code string
+	Name string
+	Token string
+	Target string
+	Locked bool
+	Id string
+	Approve bool
+	Paused bool
+}
+
+// HandleHost serves a host-only endpoint, building the command to run from the request
+func HandleHost(rooms *LockedRooms, build func(req *HostReq) Command) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		var req HostReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from host request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		_, err = room.Submit(&AuthCmd{req.Name, req.Token, &HostCmd{req.Name, build(&req)}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// replayable lists the commands kept in the room journal, by type name. Anything else either leaves
+// the room alone or, like reclaiming a seat, only touches session secrets that can't be replayed, and
+// journals any event it logs as an EventCmd.
+var replayable = map[string]func() Command{
+	"JoinCmd": func() Command { return &JoinCmd{} },
+	"PresenceCmd": func() Command { return &PresenceCmd{} },
+	"InputCmd": func() Command { return &InputCmd{} },
+	"RuleCmd": func() Command { return &RuleCmd{} },
+	"LeaveCmd": func() Command { return &LeaveCmd{} },
+	"KickCmd": func() Command { return &KickCmd{} },
+	"TransferHostCmd": func() Command { return &TransferHostCmd{} },
+	"LockCmd": func() Command { return &LockCmd{} },
+	"RestartCmd": func() Command { return &RestartCmd{} },
+	"ModerateRuleCmd": func() Command { return &ModerateRuleCmd{} },
+	"SettingsCmd": func() Command { return &SettingsCmd{} },
+	"RepairCmd": func() Command { return &RepairCmd{} },
+	"TimeoutCmd": func() Command { return &TimeoutCmd{} },
+	"SeatCmd": func() Command { return &SeatCmd{} },
+	"BoardEditCmd": func() Command { return &BoardEditCmd{} },
+	"EventCmd": func() Command { return &EventCmd{} },
+}
+
+// JournalEntry is one command that changed the room, in the order it was applied
+type JournalEntry struct {
+	Kind string `json:"kind"`
+	Time time.Time `json:"time"`
+	Command json.RawMessage `json:"command"`
+}
+
+func (e *JournalEntry) decode() (Command, error) {
+	build, ok := replayable[e.Kind]
+	if !ok {
+		return nil, errors.New("unknown journal entry " + e.Kind)
+	}
+	cmd := build()
+	err := json.Unmarshal(e.Command, cmd)
+	return cmd, err
+}
+
+// journalCommand returns the form of cmd to keep in the journal, or nil if it isn't kept. Checks
+// that passed when the command ran, like tokens and hosting, are dropped.
+func journalCommand(cmd Command) Command {
+	switch c := cmd.(type) {
+	case *AuthCmd:
+		return journalCommand(c.Cmd)
+	case *HostCmd:
+		return journalCommand(c.Cmd)
+	case *JoinCmd:
+		return &JoinCmd{Name: c.Name}
+	case *ConnectCmd:
+		return &PresenceCmd{Name: c.Name, Connected: true}
+	case *DisconnectCmd:
+		return &PresenceCmd{Name: c.Name, Connected: false}
+	case *PromoteCmd:
+		return &SeatCmd{Name: c.Target}
+	}
+	if _, ok := replayable[commandKind(cmd)]; ok {
+		return cmd
+	}
+	return nil
+}
+
+// commandKind is the type name a command is journaled under, whether or not it is a pointer
+func commandKind(cmd Command) string {
+	t := reflect.TypeOf(cmd)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// newJournalEntry encodes cmd before it runs, since running it may fill in parts of it
+func newJournalEntry(cmd Command) *JournalEntry {
+	jcmd := journalCommand(cmd)
+	if jcmd == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(jcmd)
+	if err != nil {
+		return nil
+	}
+	return &JournalEntry{
+		Kind: commandKind(jcmd),
+		Time: time.Now(),
+		Command: encoded,
+	}
+}
+
+// PresenceCmd stands in for a stream connecting or disconnecting when the journal is replayed
+type PresenceCmd struct {
+	Name string
+	Connected bool
+}
+
+func (c *PresenceCmd) Apply(r *Room) (interface{}, bool, error) {
+	player, _ := r.GetPlayer(c.Name)
+	if player == nil || player.Connected == c.Connected {
+		return nil, false, nil
+	}
+	player.Connected = c.Connected
+	if player.Name == r.Host && !player.Connected {
+		r.handOverHost()
+	}
+	return nil, true, nil
+}
+
+// EventCmd stands in for a command that isn't journaled when the journal is replayed, logging the
+// event it left in the history
+type EventCmd struct {
+	Event *Event
+}
+
+func (c *EventCmd) Apply(r *Room) (interface{}, bool, error) {
+	if c.Event == nil {
+		return nil, false, errors.New("journaled event is missing")
+	}
+	event := *c.Event
+	r.logEvent(&event)
+	return nil, true, nil
+}
+
+// logJournaledEvent logs an event for a command the journal doesn't keep, and journals the event on
+// its own so it survives the room being rebuilt for an undo or a replay
+func (r *Room) logJournaledEvent(e *Event) {
+	r.logEvent(e)
+	if entry := newJournalEntry(&EventCmd{Event: e}); entry != nil {
+		r.journal(entry)
+	}
+}
+
+// Replay rebuilds a room by applying the first steps entries of a journal to a fresh room with the
+// same seed, or the whole journal when steps is negative. Commands that failed when they first ran
+// fail the same way again, so their errors are part of the replay rather than a reason to stop.
+func Replay(code string, seed int64, pkg *BoardPackage, journal []*JournalEntry, steps int) (*Room, error) {
+	return replayOnto(newRoom(code, seed, pkg), journal, steps)
+}
+
+// replayOnto carries on a replay, applying entries that follow on from the room's own journal
+func replayOnto(r *Room, journal []*JournalEntry, steps int) (*Room, error) {
+	start := len(r.Journal)
+	for idx, entry := range journal {
+		if steps >= 0 && idx >= steps {
+			break
+		}
+		cmd, err := entry.decode()
+		if err != nil {
+			return nil, fmt.Errorf("journal entry %d: %s", start + idx, err.Error())
+		}
+		r.clock = entry.Time
+		r.display.begin()
+		cmd.Apply(r)
+		r.Journal = append(r.Journal, entry)
+	}
+	r.clock = time.Time{}
+	return r, nil
+}
+
+// ReplayCmd returns the room as it was after Step journal entries, or as it is now when Step is
+// negative, along with how many entries there are. It is only for those who may see the game log.
+type ReplayCmd struct {
+	Name string
+	Token string
+	Step int
+}
+
+func (c *ReplayCmd) Apply(r *Room) (interface{}, bool, error) {
+	if err := r.canSeeGameLog(c.Name, c.Token); err != nil {
+		return nil, false, err
+	}
+	replayed, err := r.replayTo(c.Step)
+	if err != nil {
+		return nil, false, err
+	}
+
+	type ReplayRes struct {
+		Steps int `json:"steps"`
+		Room *Room `json:"room"`
+	}
+	encoded, err := json.Marshal(&ReplayRes{Steps: len(r.Journal), Room: replayed})
+	return json.RawMessage(encoded), false, err
+}
+
+func HandleReplay(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		query := r.URL.Query()
+		code := query.Get("code")
+		if code == "" {
+			WriteError(w, "did not have room code in request", http.StatusBadRequest)
+			return
+		}
+		step := -1
+		if s := query.Get("step"); s != "" {
+			var err error
+			step, err = strconv.Atoi(s)
+			if err != nil || step < 0 {
+				WriteError(w, "step must be a whole number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		room, ok := rooms.Get(code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		res, err := room.Submit(&ReplayCmd{Name: query.Get("name"), Token: query.Get("token"), Step: step})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// runReplay is the replay subcommand. It replays an exported game log up to an optional step and
+// prints the resulting room, so a bug report's log can be stepped through locally.
+func runReplay(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: server replay <exported log> [step]")
+		return 2
+	}
+
+	step := -1
+	if len(args) == 2 {
+		var err error
+		step, err = strconv.Atoi(args[1])
+		if err != nil || step < 0 {
+			fmt.Fprintln(os.Stderr, "step must be a whole number")
+			return 2
+		}
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	var gameLog GameLog
+	if err := json.Unmarshal(data, &gameLog); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	boardsDir := os.Getenv("BOARDS_DIR")
+	if boardsDir == "" {
+		boardsDir = "boards"
+	}
+	boards, err := LoadBoards(boardsDir, getImage())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	pkg, ok := boards.Get(gameLog.BoardId)
+	if gameLog.Generated != nil {
+		pkg, err = GenerateBoard(*gameLog.Generated)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	} else if gameLog.BoardId != "" && !ok {
+		fmt.Fprintln(os.Stderr, "no such board " + gameLog.BoardId)
+		return 1
+	}
+
+	replayed, err := Replay(gameLog.Code, gameLog.Seed, pkg, gameLog.Journal, step)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if step < 0 && replayed.Draws != gameLog.Draws {
+		fmt.Fprintf(os.Stderr, "replay drew %d random numbers but the game drew %d, it has diverged\n", replayed.Draws, gameLog.Draws)
+	}
+
+	encoded, err := json.MarshalIndent(replayed, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println(string(encoded))
+	return 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testRoom makes a room on the built in board with players seated in order and settings applied
+// over the defaults. Commands are run through execute, just as the room goroutine runs them,
+// without a store or streams.
+func testRoom(t *testing.T, seed int64, settings string, players ...string) *Room {
+	r := newRoom("TEST", seed, defaultBoardPackage(nil))
+	for _, name := range players {
+		r.execute(&JoinCmd{Name: name})
+	}
+	if settings != "" {
+		if _, err := r.execute(&SettingsCmd{Name: players[0], Settings: json.RawMessage(settings)}); err != nil {
+			t.Fatalf("settings %s: %s", settings, err.Error())
+		}
+	}
+	return r
+}
+
+// nextInput is the input the game is waiting on next, or nil once someone has won
+func nextInput(r *Room) *Input {
+	if len(r.InputReqs) == 0 {
+		return &Input{Name: r.Players[0].Name}
+	}
+	req := r.InputReqs[0]
+	if req.Type == VICTORY {
+		return nil
+	}
+	for _, name := range req.Names {
+		if req.GetReceivedForName(name) == nil {
+			return &Input{Name: name}
+		}
+	}
+	return nil
+}
+
+// play gives the game up to steps inputs, stopping early once someone wins
+func play(t *testing.T, r *Room, steps int) {
+	playOn(t, r, steps, false)
+}
+
+// playOn is play that, when again is set, has each winner add a rule and carries on with a new game
+func playOn(t *testing.T, r *Room, steps int, again bool) {
+	for i := 0; i < steps; i++ {
+		input := nextInput(r)
+		if input == nil && again {
+			winner := r.InputReqs[0].Names[0]
+			r.execute(&RuleCmd{Name: winner, Type: GENERIC, Trigger: ONBATTLE, FlavorText: "%s drinks"})
+			continue
+		}
+		if input == nil {
+			return
+		}
+		if _, err := r.execute(&InputCmd{Input: *input}); err != nil {
+			t.Fatalf("input %d from %s: %s", i, input.Name, err.Error())
+		}
+	}
+}
+
+// gameState is the part of a room that replaying its journal has to reproduce. Times are left out,
+// since a replay stamps events with when their commands were journaled.
+func gameState(t *testing.T, r *Room) string {
+	players := []Player{}
+	for _, p := range r.Players {
+		players = append(players, Player{Name: p.Name, Location: p.Location, Path: p.Path})
+	}
+	encoded, err := json.Marshal(map[string]interface{}{
+		"players": players,
+		"current_player": r.CurrentPlayer,
+		"board": r.Board,
+		"input_reqs": r.InputReqs,
+		"history": r.History,
+		"settings": r.Settings,
+		"turn_skips": r.TurnSkips,
+		"modifiers": r.Modifiers,
+		"host": r.Host,
+		"pending_rules": r.PendingRules,
+		"needs_recovery": r.NeedsRecovery,
+		"draws": r.Draws,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestReplayMatchesLiveRoom(t *testing.T) {
+	tests := []struct {
+		name string
+		settings string
+		players []string
+		setup []Command
+	}{
+		{"two players", "", []string{"a", "b"}, nil},
+		{"four players with doubles", `{"dice_count": 2, "doubles_roll_again": true}`, []string{"a", "b", "c", "d"}, nil},
+		{"advantage and exact wins", `{"roll_mode": "ADVANTAGE", "victory_mode": "EXACT"}`, []string{"a", "b", "c"}, nil},
+		{"random turn order", `{"turn_order": "RANDOM"}`, []string{"a", "b", "c"}, nil},
+		{"rules in play", "", []string{"a", "b"}, []Command{
+			&RuleCmd{Name: "a", Type: MODIFIER, Trigger: EXTERNAL, ModifierAmount: 1, ModifierRolls: 2, FlavorText: "%s drinks", Locations: []string{"[3]", "[6]"}},
+			&RuleCmd{Name: "a", Type: TURNSKIP, Trigger: ONBATTLELOSE, TurnskipAmount: 1, FlavorText: "%s drinks"},
+		}},
+	}
+
+	for _, tt := range tests {
+		for seed := int64(1); seed <= 5; seed++ {
+			r := testRoom(t, seed, tt.settings, tt.players...)
+			for _, cmd := range tt.setup {
+				r.execute(cmd)
+			}
+			play(t, r, 120)
+
+			replayed, err := Replay(r.Code, r.Seed, r.boardPkg, r.Journal, -1)
+			if err != nil {
+				t.Fatalf("%s seed %d: %s", tt.name, seed, err.Error())
+			}
+			if replayed.Draws != r.Draws {
+				t.Errorf("%s seed %d: replay drew %d, the room drew %d", tt.name, seed, replayed.Draws, r.Draws)
+			}
+			if gameState(t, replayed) != gameState(t, r) {
+				t.Errorf("%s seed %d: replay does not match the room\n%s\n%s", tt.name, seed, gameState(t, replayed), gameState(t, r))
+			}
+		}
+	}
+}
+
+func TestReplayToMatchesReplayFromScratch(t *testing.T) {
+	r := testRoom(t, 7, `{"dice_count": 2}`, "a", "b", "c")
+	playOn(t, r, 3 * CHECKPOINT_INTERVAL, true)
+	if len(r.checkpoints) == 0 {
+		t.Fatalf("no checkpoints after %d journal entries", len(r.Journal))
+	}
+
+	// Forwards reuses the last replay, backwards starts from a checkpoint
+	steps := []int{0, 10, CHECKPOINT_INTERVAL, CHECKPOINT_INTERVAL + 7, len(r.Journal), 3, 2 * CHECKPOINT_INTERVAL + 1}
+	for _, step := range steps {
+		if step > len(r.Journal) {
+			continue
+		}
+		fresh, err := Replay(r.Code, r.Seed, r.boardPkg, r.Journal, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.replayTo(step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gameState(t, got) != gameState(t, fresh) {
+			t.Errorf("step %d: replaying from checkpoints does not match replaying from scratch", step)
+		}
+	}
+}
+
+func TestUndoMatchesReplayWithoutTheEntry(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		r := testRoom(t, seed, "", "a", "b")
+		playOn(t, r, 2 * CHECKPOINT_INTERVAL, true)
+		if nextInput(r) == nil {
+			// Someone already won, which undoing would take back instead
+			continue
+		}
+		journal := append([]*JournalEntry{}, r.Journal...)
+		if _, err := r.execute(&UndoCmd{Name: "a"}); err != nil {
+			t.Fatalf("seed %d: %s", seed, err.Error())
+		}
+
+		last := len(journal) - 1
+		for !undoable[journal[last].Kind] {
+			last--
+		}
+		want, err := Replay(r.Code, r.Seed, r.boardPkg, append(journal[:last:last], journal[last + 1:]...), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The undo's own event is journaled on its own, after everything it kept
+		want.logEvent(&Event{Type: EVENT_UNDO, Actor: "a"})
+		if gameState(t, r) != gameState(t, want) {
+			t.Errorf("seed %d: undo does not match replaying without the undone entry\n%s\n%s", seed, gameState(t, r), gameState(t, want))
+		}
+	}
+}
+
+func TestUndoKeepsEventsOfUnjournaledCommands(t *testing.T) {
+	r := testRoom(t, 3, "", "a", "b")
+	play(t, r, 4)
+	r.execute(&PauseTimerCmd{Name: "a", Paused: true})
+	play(t, r, 1)
+	r.execute(&UndoCmd{Name: "a"})
+	r.execute(&UndoCmd{Name: "a"})
+
+	count := func(events []*Event) map[string]int {
+		counts := map[string]int{}
+		for _, e := range events {
+			counts[e.Type]++
+		}
+		return counts
+	}
+	counts := count(r.Events)
+	if counts[EVENT_TIMER_PAUSED] != 1 || counts[EVENT_UNDO] != 2 {
+		t.Errorf("after two undos the room has %v", counts)
+	}
+
+	replayed, err := Replay(r.Code, r.Seed, r.boardPkg, r.Journal, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed.History, r.History) {
+		t.Errorf("replayed history\n%v\ndoes not match\n%v", replayed.History, r.History)
+	}
+}
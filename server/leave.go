@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RemovePlayer takes a player out of the room without leaving the game waiting on them. Anything
+// pending for them, including battles they were part of, is dropped and if it was their turn the
+// next player goes.
+func (r *Room) RemovePlayer(name string) error {
+	player, pidx := r.GetPlayer(name)
+	if player == nil {
+		return errors.New("no such player")
+	}
+
+	for conn, _ := range player.Conns {
+		conn.Close()
+	}
+
+	// A round that was only waiting on its winner for a new rule is over once they're gone
+	underway := r.RoundUnderway() && r.InputReqs[0].Type != VICTORY
+	r.ClearPendingForPlayer(name)
+	// Battles they already rolled for can't finish without them either
+	nInputReqs := []*InputRequest{}
+	for _, req := range r.InputReqs {
+		if _, ok := getIdx(req.Names, name); !ok || req.Type != BATTLE {
+			nInputReqs = append(nInputReqs, req)
+		}
+	}
+	r.InputReqs = nInputReqs
+
+	r.Players = append(r.Players[:pidx:pidx], r.Players[pidx + 1:]...)
+	delete(r.TurnSkips, name)
+	delete(r.Modifiers, name)
+	delete(r.reclaims, name)
+	r.updatePendingReclaims()
+	r.LastUpdate = time.Now()
+
+	if len(r.Players) == 0 {
+		r.Host = ""
+		r.CurrentPlayer = ""
+		r.InputReqs = []*InputRequest{}
+		return nil
+	}
+
+	// Seats after the leaver shifted down by one, so pidx is now the seat after theirs
+	if r.Host == name {
+		r.Host = r.Players[pidx % len(r.Players)].Name
+		for i := 0; i < len(r.Players); i++ {
+			candidate := r.Players[(pidx + i) % len(r.Players)]
+			if candidate.Connected {
+				r.Host = candidate.Name
+				break
+			}
+		}
+		r.logEvent(&Event{Type: EVENT_HOST_CHANGED, Target: r.Host})
+	}
+
+	// Nothing to fix up between rounds, the next input starts a new game from the start
+	if !underway || r.CurrentPlayer == "" {
+		return nil
+	}
+
+	if len(r.InputReqs) == 0 {
+		if r.CurrentPlayer == name {
+			r.StartTurnFrom(pidx)
+		} else {
+			_, cidx := r.GetPlayer(r.CurrentPlayer)
+			r.StartTurnFrom(cidx + 1)
+		}
+	} else if r.CurrentPlayer == name {
+		// Others still have things to resolve, so hand the turn to the seat before so it passes on
+		// to the seat after once they're done
+		r.CurrentPlayer = r.Players[(pidx + len(r.Players) - 1) % len(r.Players)].Name
+	}
+	return nil
+}
+
+// LeaveCmd lets a player give up their seat
+type LeaveCmd struct {
+	Name string
+}
+
+func (c *LeaveCmd) Apply(r *Room) (interface{}, bool, error) {
+	if player, _ := r.GetPlayer(c.Name); player == nil {
+		return nil, false, errors.New("no such player")
+	}
+	r.logEvent(&Event{Type: EVENT_LEAVE, Actor: c.Name})
+	return nil, true, r.RemovePlayer(c.Name)
+}
+
+func HandleLeave(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type LeaveReq struct {
+			Code string
+			Name string
+			Token string
+		}
+		var req LeaveReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from leave request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		_, err = room.Submit(&AuthCmd{req.Name, req.Token, &LeaveCmd{Name: req.Name}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
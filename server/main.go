@@ -6,20 +6,19 @@ import (
 	"math/rand"
 	"net/http"
 	"sync"
-	"time"
 	"encoding/json"
-	"strconv"
 	"github.com/markbates/pkger"
 	"github.com/gorilla/websocket"
 	"os"
+	"io"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 
-func RandStringRunes(n int) string {
+func RandStringRunes(rng *rand.Rand, n int) string {
     b := make([]byte, n)
     for i := range b {
-        b[i] = letters[rand.Intn(len(letters))]
+        b[i] = letters[rng.Intn(len(letters))]
     }
     return string(b)
 }
@@ -48,21 +47,57 @@ func WriteError(w http.ResponseWriter ,err string, statusCode int) {
 	json.NewEncoder(w).Encode(JSONError{err})
 }
 
-func (r *Room) NotifyPlayers() {
+// WriteCommandError reports a failed room command, telling auth failures apart from bad requests
+func WriteCommandError(w http.ResponseWriter, err error) {
+	if err == ErrUnauthorized {
+		WriteError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == ErrNotHost {
+		WriteError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	WriteError(w, err.Error(), http.StatusBadRequest)
+}
+
+func (r *Room) NotifyPlayers(msg interface{}) {
 	for _, player := range r.Players {
-		for ws, _ := range player.Conns {
-			err := ws.WriteJSON(struct{}{})
-			if err != nil {
-				ws.Close()
-				delete(player.Conns, ws)
+		for conn, _ := range player.Conns {
+			if !conn.Send(msg) {
+				delete(player.Conns, conn)
+				player.updateConnected()
 			}
 		}
 	}
+	// Spectators and displays that fell behind are cleaned up when their stream ends
+	for conn, _ := range r.spectators {
+		conn.Send(msg)
+	}
+	for conn, _ := range r.displays {
+		conn.Send(msg)
+	}
 }
 
 type LockedRooms struct {
 	sync.RWMutex
 	Rooms map[string]*Room
+	Store RoomStore
+	Reaped int
+	Boards *BoardCatalog
+	rng *rand.Rand
+}
+
+func (rooms *LockedRooms) Get(code string) (*Room, bool) {
+	rooms.RLock()
+	defer rooms.RUnlock()
+	room, ok := rooms.Rooms[code]
+	return room, ok
+}
+
+// add registers and starts a room. Callers must hold the rooms lock.
+func (rooms *LockedRooms) add(room *Room) {
+	room.Start(rooms.Store)
+	rooms.Rooms[room.Code] = room
 }
 
 func HandleCreate(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
@@ -71,6 +106,42 @@ func HandleCreate(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
+		// The body is optional, a fixed seed makes the game reproducible. Generate builds a new board
+		// from its params instead of using one from the catalog.
+		type CreateReq struct {
+			Seed *int64
+			Board string
+			Generate json.RawMessage
+		}
+		var req CreateReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && err != io.EOF {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		seed := newSeed()
+		if req.Seed != nil {
+			seed = *req.Seed
+		}
+		pkg, ok := rooms.Boards.Get(req.Board)
+		if req.Board != "" && !ok {
+			WriteError(w, "no such board", http.StatusBadRequest)
+			return
+		}
+		if len(req.Generate) > 0 {
+			params := defaultBoardParams()
+			params.Seed = seed
+			if err := json.Unmarshal(req.Generate, &params); err != nil {
+				WriteError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pkg, err = GenerateBoard(params)
+			if err != nil {
+				WriteError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		rooms.Lock()
 		defer rooms.Unlock()
 
@@ -79,13 +150,15 @@ func HandleCreate(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 		}
 		
 		for i := 0; i < 10000; i++ {
-			code := &CreateRes{Code: RandStringRunes(6)}
+			code := &CreateRes{Code: RandStringRunes(rooms.rng, 6)}
 
 			if _, ok := rooms.Rooms[code.Code]; ok {
 				continue
 			}
 
-			rooms.Rooms[code.Code] = newRoom(code.Code)
+			room := newRoom(code.Code, seed, pkg)
+			rooms.add(room)
+			room.persist()
 			w.WriteHeader(http.StatusCreated)
 			json.NewEncoder(w).Encode(code)
 			return
@@ -105,6 +178,7 @@ func HandleJoin(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 		type JoinReq struct {
 			Code string
 			Name string
+			Token string
 		}
 		var joinReq JoinReq
 		err := json.NewDecoder(r.Body).Decode(&joinReq)
@@ -117,34 +191,20 @@ func HandleJoin(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[joinReq.Code]
-		rooms.Unlock()
-
+		room, ok := rooms.Get(joinReq.Code)
 		if !ok {
 			WriteError(w, "tried to join nonexistant lobby", http.StatusBadRequest)
 			return
 		}
 
-		room.Lock()
-		defer room.Unlock()
-
-		for _, player := range room.Players {
-			if player.Name == joinReq.Name {
-				w.WriteHeader(http.StatusCreated)
-				json.NewEncoder(w).Encode(room)
-				return
-			}
+		snap, err := room.Submit(&JoinCmd{Name: joinReq.Name, Token: joinReq.Token})
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		newPlayer := &Player{Name: joinReq.Name, Conns: map[*websocket.Conn]bool{}, Location: room.Board.Locations[0].Name}
-		room.Players = append(room.Players, newPlayer)
-		room.LastUpdate = time.Now()
-
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(room)
-		room.NotifyPlayers()
-
+		json.NewEncoder(w).Encode(snap)
 		return
 	}
 }
@@ -169,44 +229,20 @@ func HandleBoardState(rooms *LockedRooms) func(http.ResponseWriter, *http.Reques
 			return
 		}
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[stateReq.Code]
-		rooms.Unlock()
-
+		room, ok := rooms.Get(stateReq.Code)
 		if !ok {
 			WriteError(w, "tried to get board state for nonexistant lobby", http.StatusBadRequest)
 			return
 		}
 
-		room.Lock()
-		defer room.Unlock()
-
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(room)
-		return
-	}
-}
-
-func HandleImage(img []byte) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
-		w.Header().Set("Content-Type", "image/jpeg")
-		w.Header().Set("Content-Length", strconv.Itoa(len(img)))
-
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
-		w.WriteHeader(http.StatusAccepted)
-		_, err := w.Write(img)
+		snap, err := room.Submit(&StateCmd{})
 		if err != nil {
-			WriteError(w, err.Error(), http.StatusInternalServerError)
+			WriteError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(snap)
 		return
 	}
 }
@@ -241,55 +277,53 @@ func HandleStream(rooms *LockedRooms, upgrader *websocket.Upgrader) func(http.Re
 		}
 		code := codes[0]
 
+		room, ok := rooms.Get(code)
+		if !ok {
+			WriteError(w, "tried to start stream for nonexistant lobby", http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Query().Get("display") == "true" {
+			serveDisplay(room, upgrader, w, r)
+			return
+		}
+		if r.URL.Query().Get("spectate") == "true" {
+			serveSpectator(room, upgrader, w, r, r.URL.Query().Get("name"))
+			return
+		}
+
 		names, ok := r.URL.Query()["name"]
 		if !ok || len(names) == 0 {
 			WriteError(w, "did not have player name in request", http.StatusBadRequest)
 			return
 		}
 		name := names[0]
+		token := r.URL.Query().Get("token")
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[code]
-		rooms.Unlock()
+		_, err := room.Submit(&SessionCmd{Name: name, Token: token})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
 
-		if !ok {
-			WriteError(w, "tried to start stream for nonexistant lobby", http.StatusBadRequest)
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already replied with an error
+			log.Println("Failed to upgrade stream for", name, "in room", code, err.Error())
 			return
 		}
+		conn := NewConn(ws)
 
-		room.Lock()
-		defer room.Unlock()
-
-		type Heartbeat struct {
-			Heartbeat bool `json:"heartbeat"`
-		}
-
-		for _, player := range room.Players {
-			if player.Name == name {
-				ws, err := upgrader.Upgrade(w, r, nil)
-				if err != nil {
-					log.Fatalln(err.Error())
-				}
-				player.Conns[ws] = true
-
-				go func() {
-					ticker := time.NewTicker(500 * time.Millisecond)
-					for {
-						select {
-						case  <-ticker.C:
-							hb := Heartbeat{}
-							errws := ws.WriteJSON(hb)
-							if errws != nil {
-								return
-							}
-						}
-					}
-				}()
-				
-				return
-			}
+		_, err = room.Submit(&ConnectCmd{Name: name, Token: token, Conn: conn})
+		if err != nil {
+			conn.Close()
+			return
 		}
-		WriteError(w, "tried to start stream for nonexistant player", http.StatusBadRequest)
+
+		conn.ReadPump(func(msg []byte) {
+			handleStreamMessage(room, conn, name, msg)
+		})
+		room.Submit(&DisconnectCmd{Name: name, Conn: conn})
 	}
 }
 
@@ -299,8 +333,12 @@ func HandleInput(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		var input Input
-		err := json.NewDecoder(r.Body).Decode(&input)
+		var req struct {
+			Input
+			Token string
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		input := req.Input
 		if err != nil {
 			WriteError(w, err.Error(), http.StatusBadRequest)
 			return
@@ -314,24 +352,15 @@ func HandleInput(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[input.Code]
-		rooms.Unlock()
-
+		room, ok := rooms.Get(input.Code)
 		if !ok {
 			WriteError(w, "no such lobby", http.StatusBadRequest)
 			return
 		}
 
-		room.Lock()
-		defer room.Unlock()
-
-		changed, err := room.AdvanceRoomState(&input)
-		if changed {
-			room.NotifyPlayers()
-		}
+		_, err = room.Submit(&AuthCmd{input.Name, req.Token, &InputCmd{Input: input}})
 		if err != nil {
-			WriteError(w, err.Error(), http.StatusBadRequest)
+			WriteCommandError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusCreated)
@@ -346,6 +375,8 @@ func HandlePrompt(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 
 		type PromptReq struct {
 			Code string
+			Name string
+			Token string
 			Level string
 			Category string
 		}
@@ -355,68 +386,29 @@ func HandlePrompt(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			WriteError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if req.Code == "" {
-			WriteError(w, "lobby code missing from prompt request", http.StatusBadRequest)
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from prompt request", http.StatusBadRequest)
 			return
 		}
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[req.Code]
-		rooms.Unlock()
-
+		room, ok := rooms.Get(req.Code)
 		if !ok {
 			WriteError(w, "no such lobby", http.StatusBadRequest)
 			return
 		}
 
-		room.Lock()
-		defer room.Unlock()
-
-		cat, ok := room.Prompts[req.Category]
-		if !ok {
-			WriteError(w, "no such category", http.StatusBadRequest)
-		}
-
-		chosen := func()*Prompts {
-			if req.Level == "" {
-				total := 0.0
-				for _, v := range cat.Prompts {
-					total = total + v.Priority
-				}
-				r := rand.Float64() * total
-
-				acc := 0.0
-				var last *Prompts
-				for _, v := range cat.Prompts {
-					last = v
-					acc = acc + v.Priority
-					if r < acc {
-						return v
-					}
-				}
-				return last
-			} else {
-				level, ok := cat.Prompts[req.Level]
-				if !ok {
-					return nil
-				}
-				return level
-			}
-		}()
-		if chosen == nil {
-			WriteError(w, "no such level", http.StatusBadRequest)
+		prompt, err := room.Submit(&AuthCmd{req.Name, req.Token, &PromptCmd{Level: req.Level, Category: req.Category}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
 		}
 
 		type PromptResp struct {
 			Prompt string `json:"prompt"`
 		}
 
-		resp := PromptResp{
-			Prompt: chosen.Prompts[rand.Intn(len(chosen.Prompts))],
-		}
-
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(resp)
+		json.NewEncoder(w).Encode(PromptResp{Prompt: prompt.(string)})
 	}
 }
 
@@ -429,6 +421,7 @@ func HandlePing(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 		type PingReq struct {
 			Code string
 			Name string
+			Token string
 		}
 		var req PingReq
 		err := json.NewDecoder(r.Body).Decode(&req)
@@ -446,43 +439,15 @@ func HandlePing(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[req.Code]
-		rooms.Unlock()
-
+		room, ok := rooms.Get(req.Code)
 		if !ok {
 			WriteError(w, "no such lobby", http.StatusBadRequest)
 			return
 		}
 
-		room.Lock()
-		defer room.Unlock()
-
-		type Ping struct {
-			Ping string `json:"ping"`
-		}
-
-		if len(room.InputReqs) > 0 {
-			recv := map[string]bool{}
-			for _, input := range room.InputReqs[0].Received {
-				recv[input.Name] = true
-			}
-
-			for _, name := range room.InputReqs[0].Names {
-				if gotten, _ := recv[name]; !gotten {
-					player, _ := room.GetPlayer(name)
-					for ws, _ := range player.Conns {
-						nerr := ws.WriteJSON(Ping{req.Name})
-						if nerr != nil {
-							err = nerr
-						}
-					}
-				}
-			}
-		}
-
+		_, err = room.Submit(&AuthCmd{req.Name, req.Token, &PingCmd{Name: req.Name}})
 		if err != nil {
-			WriteError(w, err.Error(), http.StatusBadRequest)
+			WriteCommandError(w, err)
 			return
 		}
 		
@@ -499,6 +464,7 @@ func HandleRule(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 		type RuleReq struct {
 			Code string
 			Name string
+			Token string
 			Id string
 			Delete bool
 			Locations []string
@@ -508,6 +474,9 @@ func HandleRule(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			KnockbackAmount int
 			WormholeTarget string
 			TurnskipAmount int
+			ModifierAmount int
+			ModifierRolls int
+			ModifierMode string
 		}
 		var req RuleReq
 		err := json.NewDecoder(r.Body).Decode(&req)
@@ -515,44 +484,82 @@ func HandleRule(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
 			WriteError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if req.Code == "" {
-			WriteError(w, "lobby code missing from prompt request", http.StatusBadRequest)
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from prompt request", http.StatusBadRequest)
 			return
 		}
 
-		rooms.Lock()
-		room, ok := rooms.Rooms[req.Code]
-		rooms.Unlock()
-
+		room, ok := rooms.Get(req.Code)
 		if !ok {
 			WriteError(w, "no such lobby", http.StatusBadRequest)
 			return
 		}
 
-		room.Lock()
-		defer room.Unlock()
-
-		if req.Delete {
-			room.RemoveEffect(req.Id)
-		} else {
-			room.AddEffect(req.Name, req.Type, req.Trigger, req.Locations, req.FlavorText,
-		        			req.KnockbackAmount, req.WormholeTarget, req.TurnskipAmount)
+		_, err = room.Submit(&AuthCmd{req.Name, req.Token, &RuleCmd{
+			Name: req.Name,
+			Id: req.Id,
+			Delete: req.Delete,
+			Locations: req.Locations,
+			FlavorText: req.FlavorText,
+			Type: req.Type,
+			Trigger: req.Trigger,
+			KnockbackAmount: req.KnockbackAmount,
+			WormholeTarget: req.WormholeTarget,
+			TurnskipAmount: req.TurnskipAmount,
+			ModifierAmount: req.ModifierAmount,
+			ModifierRolls: req.ModifierRolls,
+			ModifierMode: req.ModifierMode,
+		}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
 		}
 
 		w.WriteHeader(http.StatusOK)
-		room.NotifyPlayers()
 	}
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		os.Exit(runGenerate(os.Args[2:]))
+	}
+
 	host := "0.0.0.0"
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "4000"
 	}
 
-	rooms := &LockedRooms{Rooms: make(map[string]*Room)}
+	storeDir := os.Getenv("ROOM_STORE_DIR")
+	if storeDir == "" {
+		storeDir = "rooms"
+	}
+	store, err := NewFileRoomStore(storeDir)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	boardsDir := os.Getenv("BOARDS_DIR")
+	if boardsDir == "" {
+		boardsDir = "boards"
+	}
+	boards, err := LoadBoards(boardsDir, getImage())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	rooms := &LockedRooms{Rooms: make(map[string]*Room), Store: store, Boards: boards, rng: rand.New(rand.NewSource(newSeed()))}
+	err = rooms.LoadFromStore()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	rooms.StartReaper(roomTTL())
 
 	checkOrigin := func(r *http.Request)bool{ 
 		{ return true }
@@ -561,17 +568,51 @@ func main() {
 		CheckOrigin: checkOrigin,
 	}
 
-	img := getImage()
 
 	http.HandleFunc("/api/create", HandleCreate(rooms))
 	http.HandleFunc("/api/join", HandleJoin(rooms))
 	http.HandleFunc("/api/state", HandleBoardState(rooms))
-	http.HandleFunc("/api/board", HandleImage(img))
+	http.HandleFunc("/api/board", HandleImage(rooms))
+	http.HandleFunc("/api/boards", HandleBoards(boards))
+	http.HandleFunc("/api/render", HandleRender(rooms))
 	http.HandleFunc("/api/stream", HandleStream(rooms, upgrader))
 	http.HandleFunc("/api/input", HandleInput(rooms))
 	http.HandleFunc("/api/prompt", HandlePrompt(rooms))
 	http.HandleFunc("/api/ping", HandlePing(rooms))
 	http.HandleFunc("/api/rule", HandleRule(rooms))
+	http.HandleFunc("/api/repair", HandleRepair(rooms))
+	http.HandleFunc("/api/reclaim", HandleReclaim(rooms))
+	http.HandleFunc("/api/reclaim/approve", HandleApproveReclaim(rooms))
+	http.HandleFunc("/api/export", HandleExport(rooms))
+	http.HandleFunc("/api/replay", HandleReplay(rooms))
+	http.HandleFunc("/api/leave", HandleLeave(rooms))
+	http.HandleFunc("/api/host/kick", HandleHost(rooms, func(req *HostReq) Command {
+		return &KickCmd{Name: req.Name, Target: req.Target}
+	}))
+	http.HandleFunc("/api/host/transfer", HandleHost(rooms, func(req *HostReq) Command {
+		return &TransferHostCmd{Name: req.Name, Target: req.Target}
+	}))
+	http.HandleFunc("/api/host/lock", HandleHost(rooms, func(req *HostReq) Command {
+		return &LockCmd{Name: req.Name, Locked: req.Locked}
+	}))
+	http.HandleFunc("/api/host/restart", HandleHost(rooms, func(req *HostReq) Command {
+		return &RestartCmd{Name: req.Name}
+	}))
+	http.HandleFunc("/api/host/settings", HandleSettings(rooms))
+	http.HandleFunc("/api/host/board", HandleBoardEdit(rooms))
+	http.HandleFunc("/api/host/rule", HandleHost(rooms, func(req *HostReq) Command {
+		return &ModerateRuleCmd{Name: req.Name, Id: req.Id, Approve: req.Approve}
+	}))
+	http.HandleFunc("/api/host/undo", HandleHost(rooms, func(req *HostReq) Command {
+		return &UndoCmd{Name: req.Name}
+	}))
+	http.HandleFunc("/api/host/promote", HandleHost(rooms, func(req *HostReq) Command {
+		return &PromoteCmd{Name: req.Name, Target: req.Target}
+	}))
+	http.HandleFunc("/api/host/pause", HandleHost(rooms, func(req *HostReq) Command {
+		return &PauseTimerCmd{Name: req.Name, Paused: req.Paused}
+	}))
+	http.HandleFunc("/api/admin/stats", HandleAdminStats(rooms))
 	http.Handle("/", http.FileServer(http.Dir("/home/apps/tipsy-planets/client/build")))
 	log.Println("Game server starting on", host, port)
 	log.Println(http.ListenAndServe(fmt.Sprintf("%s:%s", host, port), nil))
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Message types a client may send over its stream
+const (
+	MSG_INPUT = "input"
+	MSG_RULE = "rule"
+	MSG_PROMPT = "prompt"
+	MSG_PING = "ping"
+	MSG_STATE = "state"
+	MSG_RESYNC = "resync"
+	MSG_REPAIR = "repair"
+	MSG_APPROVE_RECLAIM = "approve_reclaim"
+	MSG_LEAVE = "leave"
+	MSG_KICK = "kick"
+	MSG_TRANSFER_HOST = "transfer_host"
+	MSG_LOCK = "lock"
+	MSG_RESTART = "restart"
+	MSG_SETTINGS = "settings"
+	MSG_MODERATE_RULE = "moderate_rule"
+	MSG_UNDO = "undo"
+	MSG_PAUSE_TIMER = "pause_timer"
+	MSG_PROMOTE = "promote"
+	MSG_EDIT_BOARD = "edit_board"
+)
+
+// ClientMessage is a request sent by a client over its stream. Id is echoed back in the reply so
+// the client can match them up.
+type ClientMessage struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Reply answers a ClientMessage with either its result or an error
+type Reply struct {
+	ReplyTo string `json:"reply_to"`
+	Ok bool `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// decodeCommand turns a client message into the same command the HTTP endpoints submit. The
+// player is always the one the stream belongs to, whatever the message says.
+func decodeCommand(room *Room, conn *Conn, name string, msg *ClientMessage) (Command, error) {
+	decode := func(v interface{}) error {
+		if len(msg.Data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(msg.Data, v)
+	}
+
+	switch msg.Type {
+	case MSG_INPUT:
+		var input Input
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		input.Name = name
+		input.Code = room.Code
+		return &InputCmd{Input: input}, nil
+	case MSG_RULE:
+		cmd := &RuleCmd{}
+		if err := decode(cmd); err != nil {
+			return nil, err
+		}
+		cmd.Name = name
+		return cmd, nil
+	case MSG_PROMPT:
+		cmd := &PromptCmd{}
+		if err := decode(cmd); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	case MSG_PING:
+		return &PingCmd{Name: name}, nil
+	case MSG_STATE:
+		return &StateCmd{}, nil
+	case MSG_RESYNC:
+		return &ResyncCmd{Conn: conn}, nil
+	case MSG_REPAIR:
+		return &RepairCmd{Name: name}, nil
+	case MSG_APPROVE_RECLAIM:
+		var data struct {
+			Target string `json:"target"`
+		}
+		if err := decode(&data); err != nil {
+			return nil, err
+		}
+		return &ApproveReclaimCmd{Name: name, Target: data.Target}, nil
+	case MSG_SETTINGS:
+		var data struct {
+			Settings json.RawMessage `json:"settings"`
+			Force bool `json:"force"`
+		}
+		if err := decode(&data); err != nil {
+			return nil, err
+		}
+		return &HostCmd{Name: name, Cmd: &SettingsCmd{Name: name, Settings: data.Settings, Force: data.Force}}, nil
+	case MSG_EDIT_BOARD:
+		var data struct {
+			Op string `json:"op"`
+			Target string `json:"target"`
+			Index *int `json:"index"`
+			Location json.RawMessage `json:"location"`
+		}
+		if err := decode(&data); err != nil {
+			return nil, err
+		}
+		return &HostCmd{Name: name, Cmd: &BoardEditCmd{Name: name, Op: data.Op, Target: data.Target, Index: data.Index, Location: data.Location}}, nil
+	case MSG_LEAVE:
+		return &LeaveCmd{Name: name}, nil
+	case MSG_KICK, MSG_TRANSFER_HOST, MSG_LOCK, MSG_RESTART, MSG_MODERATE_RULE, MSG_UNDO, MSG_PAUSE_TIMER, MSG_PROMOTE:
+		var data struct {
+			Target string `json:"target"`
+			Locked bool `json:"locked"`
+			Id string `json:"id"`
+			Approve bool `json:"approve"`
+			Paused bool `json:"paused"`
+		}
+		if err := decode(&data); err != nil {
+			return nil, err
+		}
+		cmd := map[string]Command{
+			MSG_KICK: &KickCmd{Name: name, Target: data.Target},
+			MSG_TRANSFER_HOST: &TransferHostCmd{Name: name, Target: data.Target},
+			MSG_LOCK: &LockCmd{Name: name, Locked: data.Locked},
+			MSG_RESTART: &RestartCmd{Name: name},
+			MSG_MODERATE_RULE: &ModerateRuleCmd{Name: name, Id: data.Id, Approve: data.Approve},
+			MSG_UNDO: &UndoCmd{Name: name},
+			MSG_PAUSE_TIMER: &PauseTimerCmd{Name: name, Paused: data.Paused},
+			MSG_PROMOTE: &PromoteCmd{Name: name, Target: data.Target},
+		}[msg.Type]
+		return &HostCmd{Name: name, Cmd: cmd}, nil
+	default:
+		return nil, errors.New("unknown message type " + msg.Type)
+	}
+}
+
+// handleStreamMessage runs a message read from a player's stream and replies on the same stream
+func handleStreamMessage(room *Room, conn *Conn, name string, raw []byte) {
+	var msg ClientMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		conn.Send(Reply{Ok: false, Error: "malformed message: " + err.Error()})
+		return
+	}
+
+	cmd, err := decodeCommand(room, conn, name, &msg)
+	if err != nil {
+		conn.Send(Reply{ReplyTo: msg.Id, Ok: false, Error: err.Error()})
+		return
+	}
+
+	result, err := room.Submit(cmd)
+	if err != nil {
+		conn.Send(Reply{ReplyTo: msg.Id, Ok: false, Error: err.Error()})
+		return
+	}
+	conn.Send(Reply{ReplyTo: msg.Id, Ok: true, Result: result})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_ROOM_TTL = 12 * time.Hour
+	MAX_REAP_INTERVAL = time.Minute
+)
+
+func roomTTL() time.Duration {
+	env := os.Getenv("ROOM_IDLE_TTL")
+	if env == "" {
+		return DEFAULT_ROOM_TTL
+	}
+	ttl, err := time.ParseDuration(env)
+	if err != nil || ttl <= 0 {
+		log.Println("Invalid ROOM_IDLE_TTL", env, "using default", DEFAULT_ROOM_TTL)
+		return DEFAULT_ROOM_TTL
+	}
+	return ttl
+}
+
+// Close tells every connected client the room is going away, drops their connections and stops
+// the room goroutine. Only call from within a command.
+func (r *Room) Close() {
+	type Closing struct {
+		Closing bool `json:"closing"`
+	}
+
+	for _, player := range r.Players {
+		for conn, _ := range player.Conns {
+			conn.Send(Closing{true})
+			conn.Close()
+			delete(player.Conns, conn)
+		}
+	}
+	for conn, _ := range r.spectators {
+		conn.Send(Closing{true})
+		conn.Close()
+		delete(r.spectators, conn)
+	}
+	for conn, _ := range r.displays {
+		conn.Send(Closing{true})
+		conn.Close()
+		delete(r.displays, conn)
+	}
+	r.stop()
+}
+
+// ReapIdle closes and deletes every room that has not been updated within ttl. The rooms lock is
+// only held to list the rooms and to delete the reaped ones, so a slow room never holds up lookups.
+func (rooms *LockedRooms) ReapIdle(ttl time.Duration) int {
+	rooms.RLock()
+	live := map[string]*Room{}
+	for code, room := range rooms.Rooms {
+		live[code] = room
+	}
+	rooms.RUnlock()
+
+	reaped := []string{}
+	cutoff := time.Now().Add(-ttl)
+	for code, room := range live {
+		closed, err := room.Submit(&ReapCmd{Cutoff: cutoff})
+		if err != nil && err != ErrRoomClosed {
+			log.Println("Failed to reap room", code, err.Error())
+			continue
+		}
+		if err == nil && !closed.(bool) {
+			continue
+		}
+		reaped = append(reaped, code)
+	}
+
+	// A code can be taken by a new room once its old room is closed, so only delete what was reaped
+	deleted := []string{}
+	rooms.Lock()
+	for _, code := range reaped {
+		if rooms.Rooms[code] == live[code] {
+			delete(rooms.Rooms, code)
+			deleted = append(deleted, code)
+		}
+	}
+	rooms.Reaped += len(deleted)
+	rooms.Unlock()
+
+	if rooms.Store != nil {
+		for _, code := range deleted {
+			err := rooms.Store.Delete(code)
+			if err != nil {
+				log.Println("Failed to delete room", code, "from store", err.Error())
+			}
+		}
+	}
+	return len(deleted)
+}
+
+func (rooms *LockedRooms) StartReaper(ttl time.Duration) {
+	interval := MAX_REAP_INTERVAL
+	if ttl < interval {
+		interval = ttl
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n := rooms.ReapIdle(ttl); n > 0 {
+				log.Println("Reaped", n, "idle rooms")
+			}
+		}
+	}()
+}
+
+func HandleAdminStats(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		// Stats stay closed unless an admin token has been set up
+		if token := os.Getenv("ADMIN_TOKEN"); token == "" || r.URL.Query().Get("token") != token {
+			WriteError(w, "invalid admin token", http.StatusForbidden)
+			return
+		}
+
+		type StatsResp struct {
+			Rooms int `json:"rooms"`
+			Reaped int `json:"reaped"`
+		}
+
+		rooms.RLock()
+		resp := StatsResp{Rooms: len(rooms.Rooms), Reaped: rooms.Reaped}
+		rooms.RUnlock()
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// InvalidStateError means the room got into a state the rules can't continue from. Only the room
+// it happened in is affected, and it stays paused until someone repairs it.
+type InvalidStateError struct {
+	Reason string
+}
+
+func (e *InvalidStateError) Error() string {
+	return "invalid game state: " + e.Reason
+}
+
+// checkRecovery pauses the room if err means the game state is broken
+func (r *Room) checkRecovery(err error) bool {
+	var ise *InvalidStateError
+	if !errors.As(err, &ise) {
+		return false
+	}
+	log.Println("Room", r.Code, "needs recovery:", ise.Reason)
+	r.NeedsRecovery = true
+	r.RecoveryReason = ise.Reason
+	r.logEvent(&Event{Type: EVENT_BROKEN, Detail: ise.Reason})
+	r.LastUpdate = time.Now()
+	return true
+}
+
+// Repair puts a broken room back into a playable state. Players on locations that no longer exist
+// go back to the start, pending input is dropped and the turn passes to the next player.
+func (r *Room) Repair(name string) {
+	for _, player := range r.Players {
+		if loc, _ := r.Board.GetLocation(player.Location); loc == nil {
+			player.Location = r.Board.Locations[0].Name
+		}
+	}
+
+	r.InputReqs = []*InputRequest{}
+	r.NeedsRecovery = false
+	r.RecoveryReason = ""
+	r.logEvent(&Event{Type: EVENT_REPAIRED, Actor: name})
+	r.LastUpdate = time.Now()
+
+	if len(r.Players) == 0 {
+		r.CurrentPlayer = ""
+		return
+	}
+
+	next := 0
+	if player, pidx := r.GetPlayer(r.CurrentPlayer); player != nil {
+		next = (pidx + 1) % len(r.Players)
+	}
+	r.CurrentPlayer = r.Players[next].Name
+	r.InputReqs = append(r.InputReqs, &InputRequest{
+		Names: []string{r.CurrentPlayer},
+		Type: MOVE,
+		Received: []*Input{},
+	})
+}
+
+// RepairCmd resumes a room that was paused on an invalid state
+type RepairCmd struct {
+	Name string
+}
+
+func (c *RepairCmd) Apply(r *Room) (interface{}, bool, error) {
+	if err := r.requireHost(c.Name); err != nil {
+		return nil, false, err
+	}
+	r.Repair(c.Name)
+	return nil, true, nil
+}
+
+func HandleRepair(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type RepairReq struct {
+			Code string
+			Name string
+			Token string
+		}
+		var req RepairReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from repair request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		_, err = room.Submit(&AuthCmd{req.Name, req.Token, &RepairCmd{Name: req.Name}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
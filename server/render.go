@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+var (
+	edgeColor = color.RGBA{0, 160, 0, 255}
+	wormholeColor = color.RGBA{40, 90, 255, 255}
+	ruleColor = color.RGBA{255, 0, 200, 255}
+	outlineColor = color.RGBA{20, 20, 20, 255}
+)
+
+var effectColors = map[string]color.RGBA{
+	KNOCKBACK: {230, 40, 40, 255},
+	WORMHOLE: wormholeColor,
+	TURNSKIP: {255, 150, 0, 255},
+	MODIFIER: {150, 60, 220, 255},
+	GENERIC: {250, 220, 40, 255},
+}
+
+// RenderView is the part of a room a board render needs. It is copied out of the room so the
+// drawing happens without holding up the room.
+type RenderView struct {
+	Board *GameBoard
+	Players []Player
+	pkg *BoardPackage
+}
+
+func (r *Room) renderView() *RenderView {
+	view := &RenderView{Board: &GameBoard{Effects: append([]*LocationEffect{}, r.Board.Effects...)}, Players: []Player{}, pkg: r.boardPkg}
+	for _, loc := range r.Board.Locations {
+		view.Board.Locations = append(view.Board.Locations, &Location{Name: loc.Name, X: loc.X, Y: loc.Y,
+			Effects: append([]*LocationEffect{}, loc.Effects...), Next: append([]string{}, loc.Next...)})
+	}
+	for _, player := range r.Players {
+		view.Players = append(view.Players, Player{Name: player.Name, Location: player.Location})
+	}
+	return view
+}
+
+// RenderCmd copies what's needed to draw the room's board as it is now, or as it was after Step
+// journal entries when Step isn't negative. Earlier steps are only for those who may see the game log.
+type RenderCmd struct {
+	Name string
+	Token string
+	Step int
+}
+
+func (c *RenderCmd) Apply(r *Room) (interface{}, bool, error) {
+	if c.Step < 0 {
+		return r.renderView(), false, nil
+	}
+	if err := r.canSeeGameLog(c.Name, c.Token); err != nil {
+		return nil, false, err
+	}
+	replayed, err := r.replayTo(c.Step)
+	if err != nil {
+		return nil, false, err
+	}
+	return replayed.renderView(), false, nil
+}
+
+// background decodes the board image the first time it is drawn
+func (p *BoardPackage) background() (image.Image, error) {
+	p.decode.Do(func() {
+		p.decoded, _, p.decodeErr = image.Decode(bytes.NewReader(p.Image))
+	})
+	return p.decoded, p.decodeErr
+}
+
+// playerColor matches the colors the client gives players, red turned around the color wheel by seat
+func playerColor(idx int) color.RGBA {
+	hue := math.Mod(float64(idx * 230), 360) / 60
+	x := uint8(255 * (1 - math.Abs(math.Mod(hue, 2) - 1)))
+	switch int(hue) {
+	case 0:
+		return color.RGBA{255, x, 0, 255}
+	case 1:
+		return color.RGBA{x, 255, 0, 255}
+	case 2:
+		return color.RGBA{0, 255, x, 255}
+	case 3:
+		return color.RGBA{0, x, 255, 255}
+	case 4:
+		return color.RGBA{x, 0, 255, 255}
+	default:
+		return color.RGBA{255, 0, x, 255}
+	}
+}
+
+type canvas struct {
+	*image.RGBA
+}
+
+func (c canvas) fillCircle(cx, cy, radius int, col color.RGBA) {
+	for y := cy - radius; y <= cy + radius; y++ {
+		for x := cx - radius; x <= cx + radius; x++ {
+			if (x - cx) * (x - cx) + (y - cy) * (y - cy) <= radius * radius {
+				c.SetRGBA(x, y, col)
+			}
+		}
+	}
+}
+
+func (c canvas) ring(cx, cy, radius, width int, col color.RGBA) {
+	for y := cy - radius; y <= cy + radius; y++ {
+		for x := cx - radius; x <= cx + radius; x++ {
+			d := (x - cx) * (x - cx) + (y - cy) * (y - cy)
+			if d <= radius * radius && d > (radius - width) * (radius - width) {
+				c.SetRGBA(x, y, col)
+			}
+		}
+	}
+}
+
+func (c canvas) fillRect(x0, y0, x1, y1 int, col color.RGBA) {
+	draw.Draw(c, image.Rect(x0, y0, x1, y1), &image.Uniform{col}, image.Point{}, draw.Src)
+}
+
+func (c canvas) line(x0, y0, x1, y1, width int, col color.RGBA) {
+	steps := int(math.Max(math.Abs(float64(x1 - x0)), math.Abs(float64(y1 - y0))))
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		x := x0 + (x1 - x0) * i / steps
+		y := y0 + (y1 - y0) * i / steps
+		c.fillCircle(x, y, width / 2, col)
+	}
+}
+
+// RenderBoard draws the board over its background with every location's marker and effects, a ring
+// around locations with custom rules, a frame when there are rules for the whole board, and each
+// player's token where they stand
+func RenderBoard(view *RenderView) ([]byte, error) {
+	bg, err := view.pkg.background()
+	if err != nil {
+		return nil, err
+	}
+	c := canvas{image.NewRGBA(bg.Bounds())}
+	draw.Draw(c, c.Bounds(), bg, bg.Bounds().Min, draw.Src)
+
+	board := view.Board
+	for _, loc := range board.Locations {
+		for _, next := range loc.Next {
+			if target, _ := board.GetLocation(next); target != nil {
+				c.line(loc.X, loc.Y, target.X, target.Y, 3, edgeColor)
+			}
+		}
+	}
+	for _, loc := range board.Locations {
+		for _, eff := range loc.Effects {
+			if eff.Type != WORMHOLE {
+				continue
+			}
+			if target, _ := board.GetLocation(eff.WormholeTarget); target != nil {
+				c.line(loc.X, loc.Y, target.X, target.Y, 2, wormholeColor)
+			}
+		}
+	}
+
+	for _, loc := range board.Locations {
+		c.fillCircle(loc.X, loc.Y, 5, edgeColor)
+		custom := false
+		for idx, eff := range loc.Effects {
+			if eff.Trigger != BUILTIN {
+				custom = true
+			}
+			col, ok := effectColors[eff.Type]
+			if !ok {
+				continue
+			}
+			x, y := loc.X + 9 + idx * 11, loc.Y - 17
+			c.fillRect(x - 1, y - 1, x + 10, y + 10, outlineColor)
+			c.fillRect(x, y, x + 9, y + 9, col)
+		}
+		if custom {
+			c.ring(loc.X, loc.Y, 15, 3, ruleColor)
+		}
+	}
+	if len(board.Effects) > 0 {
+		b := c.Bounds()
+		c.fillRect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y + 6, ruleColor)
+		c.fillRect(b.Min.X, b.Max.Y - 6, b.Max.X, b.Max.Y, ruleColor)
+		c.fillRect(b.Min.X, b.Min.Y, b.Min.X + 6, b.Max.Y, ruleColor)
+		c.fillRect(b.Max.X - 6, b.Min.Y, b.Max.X, b.Max.Y, ruleColor)
+	}
+
+	for idx, player := range view.Players {
+		loc, _ := board.GetLocation(player.Location)
+		if loc == nil {
+			continue
+		}
+		c.fillCircle(loc.X, loc.Y + idx * 5, 11, outlineColor)
+		c.fillCircle(loc.X, loc.Y + idx * 5, 10, playerColor(idx))
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HandleRender serves a PNG of the room's board with everyone on it, or of the board at a step of its
+// journal when given one
+func HandleRender(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		query := r.URL.Query()
+		code := query.Get("code")
+		if code == "" {
+			WriteError(w, "did not have room code in request", http.StatusBadRequest)
+			return
+		}
+		step := -1
+		if s := query.Get("step"); s != "" {
+			var err error
+			step, err = strconv.Atoi(s)
+			if err != nil || step < 0 {
+				WriteError(w, "step must be a whole number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		room, ok := rooms.Get(code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		res, err := room.Submit(&RenderCmd{Name: query.Get("name"), Token: query.Get("token"), Step: step})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		img, err := RenderBoard(res.(*RenderView))
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(img)
+	}
+}
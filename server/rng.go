@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"time"
+	"github.com/google/uuid"
+)
+
+// countingSource counts the values drawn from a source so that a restored room can pick its
+// random sequence back up exactly where it left off
+type countingSource struct {
+	src rand.Source64
+	draws *uint64
+}
+
+func (s *countingSource) Int63() int64 {
+	*s.draws++
+	return s.src.Int63()
+}
+
+func (s *countingSource) Uint64() uint64 {
+	*s.draws++
+	return s.src.Uint64()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.src.Seed(seed)
+	*s.draws = 0
+}
+
+func newSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// seedRNG sets up the room's random source from its seed, skipping the values already drawn
+func (r *Room) seedRNG() {
+	src := rand.NewSource(r.Seed).(rand.Source64)
+	for i := uint64(0); i < r.Draws; i++ {
+		src.Int63()
+	}
+	r.rng = rand.New(&countingSource{src: src, draws: &r.Draws})
+	// Prompts don't change the room, so they come from a source of their own that nobody can
+	// predict and drawing one never moves the dice along
+	r.promptRng = rand.New(rand.NewSource(newSeed()))
+}
+
+// GameLog is everything needed to look back over a game and replay it
+type GameLog struct {
+	Code string `json:"code"`
+	Seed int64 `json:"seed"`
+	Draws uint64 `json:"draws"`
+	BoardId string `json:"board_id"`
+	Generated *BoardParams `json:"generated,omitempty"`
+	Settings Settings `json:"settings"`
+	Players []string `json:"players"`
+	History []string `json:"history"`
+	Events []*Event `json:"events"`
+	Journal []*JournalEntry `json:"journal"`
+	Exported time.Time `json:"exported"`
+}
+
+// newId makes a uuid from the room's random source so that replays come out with the same ids
+func (r *Room) newId() string {
+	var id uuid.UUID
+	binary.BigEndian.PutUint64(id[:8], r.rng.Uint64())
+	binary.BigEndian.PutUint64(id[8:], r.rng.Uint64())
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id.String()
+}
+
+// canSeeGameLog checks that name may see the game log. The seed and draws in it tell what every
+// roll to come will be, so until the game is over only the host gets to see it.
+func (r *Room) canSeeGameLog(name string, token string) error {
+	if r.GameOver() {
+		return nil
+	}
+	if _, err := r.Authenticate(name, token); err != nil {
+		return err
+	}
+	if name != r.Host {
+		return ErrNotHost
+	}
+	return nil
+}
+
+// ExportCmd returns the room's game log
+type ExportCmd struct {
+	Name string
+	Token string
+}
+
+func (c *ExportCmd) Apply(r *Room) (interface{}, bool, error) {
+	if err := r.canSeeGameLog(c.Name, c.Token); err != nil {
+		return nil, false, err
+	}
+	log := &GameLog{
+		Code: r.Code,
+		Seed: r.Seed,
+		Draws: r.Draws,
+		BoardId: r.BoardId,
+		Generated: r.Generated,
+		Settings: r.Settings,
+		Players: []string{},
+		History: r.History,
+		Events: r.Events,
+		Journal: r.Journal,
+		Exported: time.Now(),
+	}
+	for _, player := range r.Players {
+		log.Players = append(log.Players, player.Name)
+	}
+	encoded, err := json.Marshal(log)
+	return json.RawMessage(encoded), false, err
+}
+
+func HandleExport(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			WriteError(w, "did not have room code in request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		log, err := room.Submit(&ExportCmd{Name: query.Get("name"), Token: query.Get("token")})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(log)
+	}
+}
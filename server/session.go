@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	TOKEN_BYTES = 16
+	// RECLAIM_EXPIRY is how long a claim on a seat holds off other claims before it lapses
+	RECLAIM_EXPIRY = 10 * time.Minute
+)
+
+var ErrUnauthorized = errors.New("invalid or missing session token")
+
+func newToken() string {
+	b := make([]byte, TOKEN_BYTES)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken mints a fresh session token for the player, invalidating any previous one
+func (p *Player) issueToken() string {
+	token := newToken()
+	p.TokenHash = hashToken(token)
+	return token
+}
+
+func (p *Player) checkToken(token string) bool {
+	if p.TokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(p.TokenHash), []byte(hashToken(token))) == 1
+}
+
+// Authenticate returns the player if token is their current session token
+func (r *Room) Authenticate(name string, token string) (*Player, error) {
+	player, _ := r.GetPlayer(name)
+	if player == nil || !player.checkToken(token) {
+		return nil, ErrUnauthorized
+	}
+	return player, nil
+}
+
+// AuthCmd runs Cmd only if Token belongs to Name. Streams authenticate once when they connect, so
+// this is for the HTTP endpoints.
+type AuthCmd struct {
+	Name string
+	Token string
+	Cmd Command
+}
+
+func (c *AuthCmd) Apply(r *Room) (interface{}, bool, error) {
+	if _, err := r.Authenticate(c.Name, c.Token); err != nil {
+		return nil, false, err
+	}
+	return c.Cmd.Apply(r)
+}
+
+// joinResult is the room snapshot plus the session token when one was just issued
+func (r *Room) joinResult(token string) (json.RawMessage, error) {
+	return json.Marshal(struct {
+		*Room
+		Token string `json:"token,omitempty"`
+	}{r, token})
+}
+
+// seatReclaim tracks a request by someone who lost their token to take back their seat
+type seatReclaim struct {
+	ClaimHash string
+	Approved bool
+	Requested time.Time
+}
+
+func (s *seatReclaim) expired() bool {
+	return time.Since(s.Requested) > RECLAIM_EXPIRY
+}
+
+// ReclaimCmd either asks to take back a seat, or once another player has approved, hands back a
+// new session token for it. Seats with no token at all, e.g. from before tokens existed, are handed
+// back straight away. Only one claim on a seat is pending at a time, so nobody can swap theirs in
+// for the owner's before it is approved, until it lapses.
+type ReclaimCmd struct {
+	Name string
+	Claim string
+}
+
+func (c *ReclaimCmd) Apply(r *Room) (interface{}, bool, error) {
+	type ReclaimRes struct {
+		Claim string `json:"claim,omitempty"`
+		Token string `json:"token,omitempty"`
+		Approved bool `json:"approved"`
+	}
+
+	player, _ := r.GetPlayer(c.Name)
+	if player == nil {
+		return nil, false, errors.New("no such player to reclaim")
+	}
+
+	if player.TokenHash == "" {
+		return ReclaimRes{Token: r.completeReclaim(player), Approved: true}, true, nil
+	}
+
+	pending, ok := r.reclaims[c.Name]
+	if ok && pending.expired() {
+		delete(r.reclaims, c.Name)
+		ok = false
+	}
+	if ok && (c.Claim == "" || subtle.ConstantTimeCompare([]byte(pending.ClaimHash), []byte(hashToken(c.Claim))) != 1) {
+		return nil, false, errors.New("someone is already reclaiming this seat")
+	}
+	if !ok {
+		claim := newToken()
+		r.reclaims[c.Name] = &seatReclaim{ClaimHash: hashToken(claim), Requested: time.Now()}
+		r.updatePendingReclaims()
+		r.logJournaledEvent(&Event{Type: EVENT_RECLAIM_REQUESTED, Actor: c.Name})
+		r.LastUpdate = time.Now()
+		return ReclaimRes{Claim: claim}, true, nil
+	}
+
+	if !pending.Approved {
+		return ReclaimRes{Claim: c.Claim}, false, nil
+	}
+	return ReclaimRes{Token: r.completeReclaim(player), Approved: true}, true, nil
+}
+
+// completeReclaim reissues the player's token and drops every stream opened with the old one
+func (r *Room) completeReclaim(player *Player) string {
+	token := player.issueToken()
+	for conn, _ := range player.Conns {
+		conn.Close()
+		delete(player.Conns, conn)
+	}
+	player.updateConnected()
+	delete(r.reclaims, player.Name)
+	r.updatePendingReclaims()
+	r.logJournaledEvent(&Event{Type: EVENT_RECLAIMED, Actor: player.Name})
+	r.LastUpdate = time.Now()
+	return token
+}
+
+// ApproveReclaimCmd lets a seated player vouch for someone reclaiming their seat
+type ApproveReclaimCmd struct {
+	Name string
+	Target string
+}
+
+func (c *ApproveReclaimCmd) Apply(r *Room) (interface{}, bool, error) {
+	if c.Name == c.Target {
+		return nil, false, errors.New("you can't approve reclaiming your own seat")
+	}
+	pending, ok := r.reclaims[c.Target]
+	if ok && pending.expired() {
+		delete(r.reclaims, c.Target)
+		r.updatePendingReclaims()
+		return nil, true, errors.New("no pending reclaim for " + c.Target)
+	}
+	if !ok {
+		return nil, false, errors.New("no pending reclaim for " + c.Target)
+	}
+	pending.Approved = true
+	r.logJournaledEvent(&Event{Type: EVENT_RECLAIM_APPROVED, Actor: c.Name, Target: c.Target})
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+func (r *Room) updatePendingReclaims() {
+	r.PendingReclaims = []string{}
+	for _, player := range r.Players {
+		if _, ok := r.reclaims[player.Name]; ok {
+			r.PendingReclaims = append(r.PendingReclaims, player.Name)
+		}
+	}
+}
+
+func HandleReclaim(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type ReclaimReq struct {
+			Code string
+			Name string
+			Claim string
+		}
+		var req ReclaimReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from reclaim request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		res, err := room.Submit(&ReclaimCmd{Name: req.Name, Claim: req.Claim})
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func HandleApproveReclaim(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type ApproveReq struct {
+			Code string
+			Name string
+			Token string
+			Target string
+		}
+		var req ApproveReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Target == "" {
+			WriteError(w, "lobby code or target missing from approve request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		_, err = room.Submit(&AuthCmd{req.Name, req.Token, &ApproveReclaimCmd{Name: req.Name, Target: req.Target}})
+		if err == ErrUnauthorized {
+			WriteError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	MAX_DICE_COUNT = 10
+	MAX_DICE_SIDES = 100
+	MAX_PLAYERS = 50
+	MAX_TURN_TIMEOUT = 600
+)
+
+// Validate checks the settings are ones the game can be played with
+func (s *Settings) Validate() error {
+	if s.DiceCount < 1 || s.DiceCount > MAX_DICE_COUNT {
+		return fmt.Errorf("dice count must be between 1 and %d", MAX_DICE_COUNT)
+	}
+	if s.DiceSides < 2 || s.DiceSides > MAX_DICE_SIDES {
+		return fmt.Errorf("dice sides must be between 2 and %d", MAX_DICE_SIDES)
+	}
+	switch s.RollMode {
+	case ROLL_NORMAL, ROLL_ADVANTAGE, ROLL_DISADVANTAGE:
+	default:
+		return errors.New("unknown roll mode " + s.RollMode)
+	}
+	if s.MaxPlayers < 0 || s.MaxPlayers > MAX_PLAYERS {
+		return fmt.Errorf("max players must be between 0 (no limit) and %d", MAX_PLAYERS)
+	}
+	switch s.TurnOrder {
+	case TURN_ORDER_SEATED, TURN_ORDER_RANDOM:
+	default:
+		return errors.New("unknown turn order " + s.TurnOrder)
+	}
+	if s.TurnTimeout < 0 || s.TurnTimeout > MAX_TURN_TIMEOUT {
+		return fmt.Errorf("turn timeout must be between 0 (no limit) and %d seconds", MAX_TURN_TIMEOUT)
+	}
+	switch s.VictoryMode {
+	case VICTORY_REACH, VICTORY_EXACT:
+	default:
+		return errors.New("unknown victory mode " + s.VictoryMode)
+	}
+	return nil
+}
+
+// RoundUnderway is true from the first roll of a game until someone wins it
+func (r *Room) RoundUnderway() bool {
+	return len(r.InputReqs) > 0
+}
+
+// GameOver is true once the last game started has been won or restarted and nothing is left to
+// resolve. A room that has never played a game isn't over.
+func (r *Room) GameOver() bool {
+	if r.RoundUnderway() {
+		return false
+	}
+	for idx := len(r.Events) - 1; idx >= 0; idx-- {
+		switch r.Events[idx].Type {
+		case EVENT_VICTORY, EVENT_RESTARTED:
+			return true
+		case EVENT_GAME_STARTED:
+			return false
+		}
+	}
+	return false
+}
+
+// SettingsCmd updates the room settings. Settings is applied over the current ones so it only
+// needs the fields being changed. Once a round is underway changes need Force.
+type SettingsCmd struct {
+	Name string
+	Settings json.RawMessage
+	Force bool
+}
+
+func (c *SettingsCmd) Apply(r *Room) (interface{}, bool, error) {
+	if r.RoundUnderway() && !c.Force {
+		return nil, false, errors.New("settings are locked while a round is underway")
+	}
+
+	settings := r.Settings
+	if len(c.Settings) > 0 {
+		if err := json.Unmarshal(c.Settings, &settings); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := settings.Validate(); err != nil {
+		return nil, false, err
+	}
+	if settings.MaxPlayers > 0 && settings.MaxPlayers < len(r.Players) {
+		return nil, false, errors.New("max players is less than the players already in the room")
+	}
+	if settings == r.Settings {
+		return settings, false, nil
+	}
+
+	r.Settings = settings
+	r.logEvent(&Event{Type: EVENT_SETTINGS_CHANGED, Actor: c.Name})
+	r.LastUpdate = time.Now()
+	return settings, true, nil
+}
+
+func HandleSettings(rooms *LockedRooms) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setupHeaders(&w, r) {
+			return
+		}
+
+		type SettingsReq struct {
+			Code string
+			Name string
+			Token string
+			Settings json.RawMessage
+			Force bool
+		}
+		var req SettingsReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" || req.Name == "" {
+			WriteError(w, "name or lobby code missing from settings request", http.StatusBadRequest)
+			return
+		}
+
+		room, ok := rooms.Get(req.Code)
+		if !ok {
+			WriteError(w, "no such lobby", http.StatusBadRequest)
+			return
+		}
+
+		settings, err := room.Submit(&AuthCmd{req.Name, req.Token, &HostCmd{req.Name, &SettingsCmd{
+			Name: req.Name,
+			Settings: req.Settings,
+			Force: req.Force,
+		}}})
+		if err != nil {
+			WriteCommandError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(settings)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+// SpectateCmd attaches a stream that watches the room without a seat. Name is optional and only
+// needed for the host to promote the spectator to a player.
+type SpectateCmd struct {
+	Name string
+	Conn *Conn
+}
+
+func (c *SpectateCmd) Apply(r *Room) (interface{}, bool, error) {
+	if c.Name != "" {
+		if player, _ := r.GetPlayer(c.Name); player != nil {
+			return nil, false, errors.New("name is already taken by a player")
+		}
+		if r.getSpectator(c.Name) != nil {
+			return nil, false, errors.New("name is already taken by a spectator")
+		}
+	}
+	r.spectators[c.Conn] = c.Name
+	r.Spectators = len(r.spectators)
+	c.Conn.Send(r.Snapshot())
+	return nil, true, nil
+}
+
+// UnspectateCmd detaches a spectator stream once its peer has gone away
+type UnspectateCmd struct {
+	Conn *Conn
+}
+
+func (c *UnspectateCmd) Apply(r *Room) (interface{}, bool, error) {
+	if _, ok := r.spectators[c.Conn]; !ok {
+		return nil, false, nil
+	}
+	delete(r.spectators, c.Conn)
+	r.Spectators = len(r.spectators)
+	return nil, true, nil
+}
+
+func (r *Room) getSpectator(name string) *Conn {
+	for conn, sname := range r.spectators {
+		if sname == name {
+			return conn
+		}
+	}
+	return nil
+}
+
+// seat adds a new player at the start and makes them host if there isn't one
+func (r *Room) seat(name string) *Player {
+	player := &Player{Name: name, Conns: map[*Conn]bool{}, Location: r.Board.Locations[0].Name}
+	player.Path = []string{player.Location}
+	r.Players = append(r.Players, player)
+	if r.Host == "" {
+		r.Host = player.Name
+	}
+	r.logEvent(&Event{Type: EVENT_JOIN, Actor: player.Name})
+	r.LastUpdate = time.Now()
+	return player
+}
+
+type Promoted struct {
+	Promoted bool `json:"promoted"`
+	Name string `json:"name"`
+	Token string `json:"token"`
+}
+
+// PromoteCmd gives a named spectator a seat between rounds. Their stream is sent the session token
+// for it and closed so they can reconnect as the player.
+type PromoteCmd struct {
+	Name string
+	Target string
+}
+
+func (c *PromoteCmd) Apply(r *Room) (interface{}, bool, error) {
+	conn := r.getSpectator(c.Target)
+	if c.Target == "" || conn == nil {
+		return nil, false, errors.New("no such spectator")
+	}
+	if player, _ := r.GetPlayer(c.Target); player != nil {
+		return nil, false, errors.New("name is already taken by a player")
+	}
+	if r.RoundUnderway() {
+		return nil, false, errors.New("spectators can only be promoted between rounds")
+	}
+	if r.Settings.MaxPlayers > 0 && len(r.Players) >= r.Settings.MaxPlayers {
+		return nil, false, errors.New("the lobby is full")
+	}
+
+	player := r.seat(c.Target)
+	conn.Send(Promoted{Promoted: true, Name: player.Name, Token: player.issueToken()})
+	conn.Close()
+	delete(r.spectators, conn)
+	r.Spectators = len(r.spectators)
+	return nil, true, nil
+}
+
+// SeatCmd stands in for a promotion when the journal is replayed
+type SeatCmd struct {
+	Name string
+}
+
+func (c *SeatCmd) Apply(r *Room) (interface{}, bool, error) {
+	r.seat(c.Name)
+	return nil, true, nil
+}
+
+// handleSpectatorMessage answers the messages a spectator may send, which can only read the room
+func handleSpectatorMessage(room *Room, conn *Conn, raw []byte) {
+	var msg ClientMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		conn.Send(Reply{Ok: false, Error: "malformed message: " + err.Error()})
+		return
+	}
+
+	var cmd Command
+	switch msg.Type {
+	case MSG_STATE:
+		cmd = &StateCmd{}
+	case MSG_RESYNC:
+		cmd = &ResyncCmd{Conn: conn}
+	default:
+		conn.Send(Reply{ReplyTo: msg.Id, Ok: false, Error: "spectators can't send " + msg.Type})
+		return
+	}
+
+	result, err := room.Submit(cmd)
+	if err != nil {
+		conn.Send(Reply{ReplyTo: msg.Id, Ok: false, Error: err.Error()})
+		return
+	}
+	conn.Send(Reply{ReplyTo: msg.Id, Ok: true, Result: result})
+}
+
+// serveSpectator runs a spectator stream until it goes away
+func serveSpectator(room *Room, upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request, name string) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		log.Println("Failed to upgrade spectator stream in room", room.Code, err.Error())
+		return
+	}
+	conn := NewConn(ws)
+
+	_, err = room.Submit(&SpectateCmd{Name: name, Conn: conn})
+	if err != nil {
+		conn.Send(Reply{Ok: false, Error: err.Error()})
+		conn.Close()
+		return
+	}
+
+	conn.ReadPump(func(msg []byte) {
+		handleSpectatorMessage(room, conn, msg)
+	})
+	room.Submit(&UnspectateCmd{Conn: conn})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RoomStore persists rooms so that games in progress survive a server restart
+type RoomStore interface {
+	Save(room *Room) error
+	Delete(code string) error
+	LoadAll() ([]*Room, error)
+}
+
+// FileRoomStore keeps one JSON file per room in a directory
+type FileRoomStore struct {
+	Dir string
+}
+
+func NewFileRoomStore(dir string) (*FileRoomStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRoomStore{Dir: dir}, nil
+}
+
+func (s *FileRoomStore) path(code string) string {
+	return filepath.Join(s.Dir, code+".json")
+}
+
+// storedRoom is the room as clients see it plus the secrets they must not
+type storedRoom struct {
+	*Room
+	TokenHashes map[string]string `json:"token_hashes"`
+	Seed int64 `json:"seed"`
+	Draws uint64 `json:"draws"`
+	Journal []*JournalEntry `json:"journal"`
+	Paths map[string][]string `json:"paths"`
+}
+
+func (s *FileRoomStore) Save(room *Room) error {
+	stored := storedRoom{Room: room, TokenHashes: map[string]string{}, Seed: room.Seed, Draws: room.Draws, Journal: room.Journal, Paths: map[string][]string{}}
+	for _, player := range room.Players {
+		stored.TokenHashes[player.Name] = player.TokenHash
+		stored.Paths[player.Name] = player.Path
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so a crash mid-write never leaves a truncated room behind
+	tmp, err := ioutil.TempFile(s.Dir, room.Code+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(room.Code))
+}
+
+func (s *FileRoomStore) Delete(code string) error {
+	err := os.Remove(s.path(code))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileRoomStore) LoadAll() ([]*Room, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []*Room{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		stored := storedRoom{Room: &Room{}}
+		err = json.Unmarshal(data, &stored)
+		if err != nil {
+			log.Println("Skipping unreadable room file", f.Name(), err.Error())
+			continue
+		}
+		room := stored.Room
+		room.Seed = stored.Seed
+		room.Draws = stored.Draws
+		room.Journal = stored.Journal
+		for _, player := range room.Players {
+			player.TokenHash = stored.TokenHashes[player.Name]
+			player.Path = stored.Paths[player.Name]
+		}
+		room.restore()
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// restore fills in the fields that are not serialized or may be missing from older saves
+func (r *Room) restore() {
+	for _, player := range r.Players {
+		player.Conns = map[*Conn]bool{}
+		player.Connected = false
+	}
+	if r.Players == nil {
+		r.Players = []*Player{}
+	}
+	if r.Board == nil {
+		r.Board = defaultGameBoard()
+	}
+	linkLocations(r.Board.Locations)
+	if r.InputReqs == nil {
+		r.InputReqs = []*InputRequest{}
+	}
+	if r.History == nil {
+		r.History = []string{}
+	}
+	r.restoreEvents()
+	if r.TurnSkips == nil {
+		r.TurnSkips = map[string]int{}
+	}
+	r.seedRNG()
+	if r.Journal == nil {
+		r.Journal = []*JournalEntry{}
+	}
+	if r.Modifiers == nil {
+		r.Modifiers = map[string][]*RollModifier{}
+	}
+	if r.Settings.RollMode == "" {
+		r.Settings.RollMode = ROLL_NORMAL
+	}
+	if r.Prompts == nil {
+		r.Prompts = newPromptsMapping()
+	}
+	r.PendingReclaims = []string{}
+	r.reclaims = map[string]*seatReclaim{}
+	r.spectators = map[*Conn]string{}
+	r.displays = map[*Conn]bool{}
+	r.display = newDisplayState()
+	r.Spectators = 0
+	if r.PendingRules == nil {
+		r.PendingRules = []*PendingRule{}
+	}
+	if r.Settings.DiceSides == 0 {
+		// Saved before there were real settings
+		approval := r.Settings.RequireRuleApproval
+		r.Settings = defaultSettings()
+		r.Settings.RequireRuleApproval = approval
+	}
+	if r.Host == "" && len(r.Players) > 0 {
+		r.Host = r.Players[0].Name
+	}
+}
+
+func (rooms *LockedRooms) LoadFromStore() error {
+	if rooms.Store == nil {
+		return nil
+	}
+	loaded, err := rooms.Store.LoadAll()
+	if err != nil {
+		return err
+	}
+	rooms.Lock()
+	defer rooms.Unlock()
+	for _, room := range loaded {
+		room.boardPkg, _ = rooms.Boards.Get(room.BoardId)
+		if room.Generated != nil {
+			pkg, err := GenerateBoard(*room.Generated)
+			if err != nil {
+				log.Println("Could not generate the board again for room", room.Code, err.Error())
+				room.Generated = nil
+			} else {
+				room.boardPkg = pkg
+			}
+		}
+		room.BoardId = room.boardPkg.Id
+		rooms.add(room)
+	}
+	log.Println("Restored", len(loaded), "rooms from store")
+	return nil
+}
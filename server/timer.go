@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+)
+
+// updateTurnTimer starts the clock whenever a new move, battle or fork input is waiting, or the setting
+// changed, and stops it when there's nothing to time. It reports whether the timer fields changed.
+func (r *Room) updateTurnTimer() bool {
+	var req *InputRequest
+	if r.Settings.TurnTimeout > 0 && !r.NeedsRecovery && len(r.InputReqs) > 0 {
+		switch r.InputReqs[0].Type {
+		case MOVE, BATTLE, FORK:
+			req = r.InputReqs[0]
+		}
+	}
+
+	if req == nil {
+		r.timed = nil
+		if r.TurnDeadline == nil && r.TurnRemaining == 0 {
+			return false
+		}
+		r.stopTurnTimer()
+		r.TurnDeadline = nil
+		r.TurnRemaining = 0
+		return true
+	}
+
+	if req == r.timed && len(req.Received) == r.timedReceived && r.Settings.TurnTimeout == r.timedTimeout {
+		return false
+	}
+	r.timed, r.timedReceived, r.timedTimeout = req, len(req.Received), r.Settings.TurnTimeout
+	r.setTurnTimer(time.Duration(r.Settings.TurnTimeout) * time.Second)
+	return true
+}
+
+// setTurnTimer gives the waiting players remaining to act, or holds it there while paused
+func (r *Room) setTurnTimer(remaining time.Duration) {
+	r.stopTurnTimer()
+	r.TurnRemaining = int64(remaining / time.Millisecond)
+	if r.TimerPaused {
+		r.TurnDeadline = nil
+		return
+	}
+	deadline := time.Now().Add(remaining)
+	r.TurnDeadline = &deadline
+	r.turnTimer = time.NewTimer(remaining)
+}
+
+func (r *Room) stopTurnTimer() {
+	if r.turnTimer == nil {
+		return
+	}
+	if !r.turnTimer.Stop() {
+		select {
+		case <-r.turnTimer.C:
+		default:
+		}
+	}
+	r.turnTimer = nil
+}
+
+// turnTimeout fires when the turn timer runs out, and never when there is no timer running
+func (r *Room) turnTimeout() <-chan time.Time {
+	if r.turnTimer == nil {
+		return nil
+	}
+	return r.turnTimer.C
+}
+
+// TimeoutCmd rolls for everyone the current move or battle is still waiting on, or takes the first
+// way on at a fork
+type TimeoutCmd struct{}
+
+func (c *TimeoutCmd) Apply(r *Room) (interface{}, bool, error) {
+	if len(r.InputReqs) == 0 {
+		return nil, false, nil
+	}
+	req := r.InputReqs[0]
+	switch req.Type {
+	case MOVE, BATTLE, FORK:
+	default:
+		return nil, false, nil
+	}
+
+	changed := false
+	for _, name := range req.Names {
+		if len(r.InputReqs) == 0 || r.InputReqs[0] != req {
+			break
+		}
+		if req.GetReceivedForName(name) != nil {
+			continue
+		}
+
+		penalty := 0
+		if r.Settings.TimeoutPenalty {
+			penalty = 1
+		}
+		r.logEvent(&Event{Type: EVENT_TIMEOUT, Actor: name, Amount: penalty})
+		changed = true
+
+		_, err := r.AdvanceRoomState(&Input{Name: name, Code: r.Code})
+		if r.checkRecovery(err) {
+			return nil, true, err
+		}
+	}
+	return nil, changed, nil
+}
+
+// PauseTimerCmd stops or restarts the turn timer with whatever time was left on it
+type PauseTimerCmd struct {
+	Name string
+	Paused bool
+}
+
+func (c *PauseTimerCmd) Apply(r *Room) (interface{}, bool, error) {
+	if r.TimerPaused == c.Paused {
+		return nil, false, nil
+	}
+
+	if c.Paused {
+		if r.TurnDeadline != nil {
+			r.TurnRemaining = int64(time.Until(*r.TurnDeadline) / time.Millisecond)
+			if r.TurnRemaining < 0 {
+				r.TurnRemaining = 0
+			}
+		}
+		r.stopTurnTimer()
+		r.TurnDeadline = nil
+		r.TimerPaused = true
+		r.logJournaledEvent(&Event{Type: EVENT_TIMER_PAUSED, Actor: c.Name})
+	} else {
+		r.TimerPaused = false
+		if r.timed != nil {
+			r.setTurnTimer(time.Duration(r.TurnRemaining) * time.Millisecond)
+		}
+		r.logJournaledEvent(&Event{Type: EVENT_TIMER_RESUMED, Actor: c.Name})
+	}
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	UNDO_DEPTH = 5
+)
+
+// undoable lists the journal entries the host can take back
+var undoable = map[string]bool{
+	"InputCmd": true,
+	"RuleCmd": true,
+	"ModerateRuleCmd": true,
+	"TimeoutCmd": true,
+}
+
+// journal keeps an entry that changed the room. Anything new to undo starts the undo depth over.
+func (r *Room) journal(entry *JournalEntry) {
+	r.Journal = append(r.Journal, entry)
+	if undoable[entry.Kind] {
+		r.undos = 0
+	}
+}
+
+// UndoCmd takes back the last roll, battle input or rule change by rebuilding the room from its
+// journal without it. Anything journaled after it, like players joining, is applied again. Random
+// draws are rebuilt as well, so doing the same thing again rolls the same again.
+type UndoCmd struct {
+	Name string
+}
+
+func (c *UndoCmd) Apply(r *Room) (interface{}, bool, error) {
+	if r.undos >= UNDO_DEPTH {
+		return nil, false, errors.New("can't undo any further")
+	}
+
+	idx := len(r.Journal) - 1
+	for ; idx >= 0; idx-- {
+		if undoable[r.Journal[idx].Kind] {
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, false, errors.New("nothing to undo")
+	}
+
+	journal := append(append([]*JournalEntry{}, r.Journal[:idx]...), r.Journal[idx + 1:]...)
+	replayed, err := r.rebuild(journal, -1, idx)
+	if err != nil {
+		return nil, false, err
+	}
+	r.forgetAfter(idx)
+	r.replaceWith(replayed)
+	r.undos++
+	r.logJournaledEvent(&Event{Type: EVENT_UNDO, Actor: c.Name})
+	r.LastUpdate = time.Now()
+	return nil, true, nil
+}
+
+// replaceWith swaps in the game state of a rebuilt room, keeping what only lives on the running
+// room: its stream connections, spectators and displays, session tokens, seat reclaims, timer,
+// checkpoints and goroutine. Fields are copied one by one rather than swapping the whole room, since
+// handlers on other goroutines may be looking at the parts that never change, like the board package.
+// New game state has to be added here too.
+func (r *Room) replaceWith(other *Room) {
+	for _, player := range other.Players {
+		if live, _ := r.GetPlayer(player.Name); live != nil {
+			player.TokenHash = live.TokenHash
+			player.Conns = live.Conns
+			player.updateConnected()
+		}
+	}
+	for _, player := range r.Players {
+		if rebuilt, _ := other.GetPlayer(player.Name); rebuilt == nil {
+			for conn, _ := range player.Conns {
+				conn.Close()
+			}
+		}
+	}
+
+	r.stopTurnTimer()
+	r.Players = other.Players
+	r.CurrentPlayer = other.CurrentPlayer
+	r.Board = other.Board
+	r.LastUpdate = other.LastUpdate
+	r.InputReqs = other.InputReqs
+	r.History = other.History
+	r.Events = other.Events
+	r.Settings = other.Settings
+	r.TurnSkips = other.TurnSkips
+	r.Modifiers = other.Modifiers
+	r.Prompts = other.Prompts
+	r.Draws = other.Draws
+	r.Journal = other.Journal
+	r.NeedsRecovery = other.NeedsRecovery
+	r.RecoveryReason = other.RecoveryReason
+	r.Host = other.Host
+	r.Locked = other.Locked
+	r.PendingRules = other.PendingRules
+	r.TurnDeadline = other.TurnDeadline
+	r.boardVersion = other.boardVersion
+	r.display = other.display
+	r.rebuilds++
+	r.timed, r.timedReceived, r.timedTimeout = nil, 0, 0
+	r.updatePendingReclaims()
+	r.seedRNG()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"io/ioutil"
+)
+
+// BoardErrors lists everything wrong with a board
+type BoardErrors []string
+
+func (e BoardErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// ValidateBoard checks a board can be played from start to finish without hitting a broken effect.
+// Boards without any edges are linked into a single track first. It returns BoardErrors with every
+// problem found, or nil if there are none.
+func ValidateBoard(locations []*Location) error {
+	errs := BoardErrors{}
+	if len(locations) < 2 {
+		errs = append(errs, "board needs at least a start and a finish")
+		return errs
+	}
+	linkLocations(locations)
+
+	names := map[string]int{}
+	for idx, loc := range locations {
+		if loc.Name == "" {
+			errs = append(errs, fmt.Sprintf("location %d has no name", idx))
+			continue
+		}
+		if _, ok := names[loc.Name]; ok {
+			errs = append(errs, fmt.Sprintf("location %s appears more than once", loc.Name))
+			continue
+		}
+		names[loc.Name] = idx
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	for _, loc := range locations {
+		seen := map[string]bool{}
+		for _, next := range loc.Next {
+			if _, ok := names[next]; !ok {
+				errs = append(errs, fmt.Sprintf("%s leads to %s which does not exist", loc.Name, next))
+			} else if next == loc.Name {
+				errs = append(errs, fmt.Sprintf("%s leads to itself", loc.Name))
+			} else if seen[next] {
+				errs = append(errs, fmt.Sprintf("%s leads to %s more than once", loc.Name, next))
+			}
+			seen[next] = true
+		}
+	}
+	if len(locations[0].Next) == 0 {
+		errs = append(errs, "the start has no way on")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	dist := distances(locations, names)
+	for idx, loc := range locations {
+		for _, eff := range loc.Effects {
+			for _, problem := range effectProblems(eff, dist[idx], names) {
+				errs = append(errs, fmt.Sprintf("%s at %s %s", strings.ToLower(eff.Type), loc.Name, problem))
+			}
+		}
+	}
+
+	reaches := reachesFinish(locations, names)
+	for idx, loc := range locations {
+		if !reaches[idx] {
+			errs = append(errs, fmt.Sprintf("%s has no way on to a finish", loc.Name))
+		}
+	}
+
+	if len(errs) == 0 && !finishReachable(locations, names) {
+		errs = append(errs, "no finish can be reached from the start")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// effectProblems describes what is wrong with a built in effect at a location dist steps from the start
+func effectProblems(eff *LocationEffect, dist int, names map[string]int) []string {
+	problems := []string{}
+
+	switch eff.Type {
+	case WORMHOLE:
+		if _, ok := names[eff.WormholeTarget]; !ok {
+			problems = append(problems, fmt.Sprintf("goes to %s which does not exist", eff.WormholeTarget))
+		}
+	case KNOCKBACK:
+		if eff.KnockbackAmount == 0 || (dist >= 0 && eff.KnockbackAmount > dist) {
+			problems = append(problems, fmt.Sprintf("knocks back %d which is off the board", eff.KnockbackAmount))
+		}
+	case TURNSKIP:
+		if eff.TurnskipAmount <= 0 {
+			problems = append(problems, "must skip at least one turn")
+		}
+	case MODIFIER:
+		if eff.ModifierRolls <= 0 {
+			problems = append(problems, "must last at least one roll")
+		}
+		switch eff.ModifierMode {
+		case "", ROLL_NORMAL, ROLL_ADVANTAGE, ROLL_DISADVANTAGE:
+		default:
+			problems = append(problems, "has unknown roll mode " + eff.ModifierMode)
+		}
+	case GENERIC:
+	default:
+		problems = append(problems, "is not a known effect type")
+	}
+
+	switch eff.Trigger {
+	case "", BUILTIN, EXTERNAL, ONBATTLE, ONBATTLEWIN, ONBATTLELOSE:
+	default:
+		problems = append(problems, "has unknown trigger " + eff.Trigger)
+	}
+
+	verbs := strings.Count(eff.FlavorText, "%") - 2 * strings.Count(eff.FlavorText, "%%")
+	if strings.Count(eff.FlavorText, "%s") != 1 || verbs != 1 {
+		problems = append(problems, "flavor text must mention the player with exactly one %s")
+	}
+	return problems
+}
+
+// distances is the fewest steps along edges and wormholes from the start to each location, or -1
+// for locations that can't be reached. Knockbacks can send players no further back than this.
+func distances(locations []*Location, names map[string]int) []int {
+	dist := make([]int, len(locations))
+	for idx := range dist {
+		dist[idx] = -1
+	}
+	dist[0] = 0
+	queue := []int{0}
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		next := append([]string{}, locations[idx].Next...)
+		for _, eff := range locations[idx].Effects {
+			if eff.Type == WORMHOLE {
+				next = append(next, eff.WormholeTarget)
+			}
+		}
+		for _, name := range next {
+			if tidx := names[name]; dist[tidx] < 0 {
+				dist[tidx] = dist[idx] + 1
+				queue = append(queue, tidx)
+			}
+		}
+	}
+	return dist
+}
+
+// reachesFinish is whether each location has some way along edges to a finish, so loops always
+// have a way out
+func reachesFinish(locations []*Location, names map[string]int) []bool {
+	reaches := make([]bool, len(locations))
+	for changed := true; changed; {
+		changed = false
+		for idx, loc := range locations {
+			if reaches[idx] {
+				continue
+			}
+			if len(loc.Next) == 0 {
+				reaches[idx] = true
+				changed = true
+				continue
+			}
+			for _, next := range loc.Next {
+				if reaches[names[next]] {
+					reaches[idx] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return reaches
+}
+
+// finishReachable walks every roll of a die from the start down every branch, following wormholes
+// and knockbacks where they land, to see if a finish can ever be reached
+func finishReachable(locations []*Location, names map[string]int) bool {
+	prev := map[int][]int{}
+	for idx, loc := range locations {
+		for _, next := range loc.Next {
+			prev[names[next]] = append(prev[names[next]], idx)
+		}
+	}
+
+	// walk is everywhere n steps from idx can end up, forward along edges or back against them
+	walk := func(idx int, n int, forward bool) map[int]bool {
+		at := map[int]bool{idx: true}
+		for ; n > 0; n-- {
+			nat := map[int]bool{}
+			for cur := range at {
+				ways := prev[cur]
+				if forward {
+					ways = []int{}
+					for _, next := range locations[cur].Next {
+						ways = append(ways, names[next])
+					}
+				}
+				if len(ways) == 0 {
+					nat[cur] = true
+				}
+				for _, way := range ways {
+					nat[way] = true
+				}
+			}
+			at = nat
+		}
+		return at
+	}
+	land := func(idx int) map[int]bool {
+		for _, eff := range locations[idx].Effects {
+			switch eff.Type {
+			case WORMHOLE:
+				return map[int]bool{names[eff.WormholeTarget]: true}
+			case KNOCKBACK:
+				if eff.KnockbackAmount < 0 {
+					return walk(idx, -eff.KnockbackAmount, true)
+				}
+				return walk(idx, eff.KnockbackAmount, false)
+			}
+		}
+		return map[int]bool{idx: true}
+	}
+
+	seen := map[int]bool{0: true}
+	queue := []int{0}
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		for roll := 1; roll <= DICE_SIZE; roll++ {
+			for stop := range walk(idx, roll, true) {
+				for next := range land(stop) {
+					if len(locations[next].Next) == 0 {
+						return true
+					}
+					if !seen[next] {
+						seen[next] = true
+						queue = append(queue, next)
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// runValidate is the validate subcommand. It checks the given board directories, or every board in
+// BOARDS_DIR, and exits non zero if any of them have problems.
+func runValidate(args []string) int {
+	dirs := args
+	if len(dirs) == 0 {
+		boardsDir := os.Getenv("BOARDS_DIR")
+		if boardsDir == "" {
+			boardsDir = "boards"
+		}
+		entries, err := ioutil.ReadDir(boardsDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(boardsDir, entry.Name()))
+			}
+		}
+	}
+
+	failed := false
+	for _, dir := range dirs {
+		pkg, err := readBoardPackage(dir)
+		if err == nil {
+			err = ValidateBoard(pkg.Locations)
+		}
+		if err == nil {
+			fmt.Println(dir + ": ok")
+			continue
+		}
+		failed = true
+		if errs, ok := err.(BoardErrors); ok {
+			fmt.Println(dir + ":")
+			for _, problem := range errs {
+				fmt.Println("  " + problem)
+			}
+		} else {
+			fmt.Println(dir + ": " + err.Error())
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// track is a board of plain locations one after the other, named as given
+func track(names ...string) []*Location {
+	locs := []*Location{}
+	for _, name := range names {
+		locs = append(locs, &Location{Name: name, Effects: []*LocationEffect{}})
+	}
+	return locs
+}
+
+func withEffect(locs []*Location, at int, eff *LocationEffect) []*Location {
+	if eff.FlavorText == "" {
+		eff.FlavorText = "%s drinks"
+	}
+	locs[at].Effects = append(locs[at].Effects, eff)
+	return locs
+}
+
+func withNext(locs []*Location, next ...[]string) []*Location {
+	for idx, n := range next {
+		locs[idx].Next = n
+	}
+	return locs
+}
+
+func TestValidateBoard(t *testing.T) {
+	tests := []struct {
+		name string
+		locations []*Location
+		// want is part of the error expected, or empty for a board that should pass
+		want string
+	}{
+		{"default board", defaultGameBoard().Locations, ""},
+		{"plain track", track("start", "a", "b", "finish"), ""},
+		{"fork that joins up", withNext(track("start", "a", "b", "finish"), []string{"a", "b"}, []string{"finish"}, []string{"finish"}), ""},
+		{"too short", track("start"), "at least a start and a finish"},
+		{"unnamed location", track("start", "", "finish"), "location 1 has no name"},
+		{"repeated name", track("start", "a", "a", "finish"), "a appears more than once"},
+		{"edge to nowhere", withNext(track("start", "a", "finish"), []string{"a"}, []string{"nowhere"}), "a leads to nowhere which does not exist"},
+		{"edge to itself", withNext(track("start", "a", "finish"), []string{"a"}, []string{"a", "finish"}), "a leads to itself"},
+		{"repeated edge", withNext(track("start", "a", "finish"), []string{"a", "a"}, []string{"finish"}), "start leads to a more than once"},
+		{"start goes nowhere", withNext(track("start", "a", "finish"), []string{}, []string{"finish"}), "the start has no way on"},
+		{"loop with no way out", withNext(track("start", "a", "b", "finish"), []string{"a"}, []string{"b"}, []string{"a"}), "no way on to a finish"},
+		{"wormhole to nowhere", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: WORMHOLE, WormholeTarget: "nowhere"}), "goes to nowhere which does not exist"},
+		{"knockback off the board", withEffect(track("start", "a", "b", "finish"), 1, &LocationEffect{Type: KNOCKBACK, KnockbackAmount: 3}), "knocks back 3 which is off the board"},
+		{"knockback of nothing", withEffect(track("start", "a", "b", "finish"), 2, &LocationEffect{Type: KNOCKBACK}), "knocks back 0"},
+		{"skip no turns", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: TURNSKIP}), "must skip at least one turn"},
+		{"modifier for no rolls", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: MODIFIER, ModifierAmount: 1}), "must last at least one roll"},
+		{"unknown roll mode", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: MODIFIER, ModifierRolls: 1, ModifierMode: "SIDEWAYS"}), "unknown roll mode SIDEWAYS"},
+		{"unknown effect", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: "TELEPORT"}), "not a known effect type"},
+		{"unknown trigger", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: GENERIC, Trigger: "SOMETIMES"}), "unknown trigger SOMETIMES"},
+		{"flavor text without the player", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: GENERIC, FlavorText: "everyone drinks"}), "exactly one %s"},
+		{"flavor text with two verbs", withEffect(track("start", "a", "finish"), 1, &LocationEffect{Type: GENERIC, FlavorText: "%s drinks %d"}), "exactly one %s"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateBoard(tt.locations)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %s", tt.name, err.Error())
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: passed, want an error about %q", tt.name, tt.want)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %q does not mention %q", tt.name, err.Error(), tt.want)
+		}
+	}
+}